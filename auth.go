@@ -5,50 +5,63 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go-http-svc/models"
+	"go-http-svc/services"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 // Register godoc
-// @Summary Register a new user
-// @Description Register a new user with a username and password
+// @Summary Register a new user with an invitation
+// @Description Redeems an invitation token issued by /api/{eid}/invitations, the exhibition
+// @Description and the role of the new user are the ones of the invitation.
 // @Tags auth
 // @Accept json
 // @Produce json
-// @Param sec  query string true  "query param"
-// @Param user body models.ExUserInput true "User registration details"
+// @Param user body models.RegisterInput true "Invitation token and user details"
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
 // @Router /register [post]
 func Register(c *gin.Context, db *gorm.DB) {
-	var input models.ExUserInput
+	var input models.RegisterInput
 	// Bind the JSON input to the user struct
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	sec := c.Query("sec")
-	if sec != "Hz20012056" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "access denined"})
+	invite, err := parseInviteToken(input.Token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired invitation"})
 		return
 	}
 
 	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	hashedPassword, err := services.HashPassword(input.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
 
-	input.Password = string(hashedPassword)
-	// Create the user record
-	user := models.ExUser{ExUserInput: input}
-	if err := db.Create(&user).Error; err != nil {
+	// Create the user record, eid and role come from the invitation
+	user := models.ExUser{ExUserInput: models.ExUserInput{
+		Name:     input.Name,
+		Uname:    input.Uname,
+		Password: hashedPassword,
+		Title:    input.Title,
+		Mobile:   input.Mobile,
+	}}
+	if err := redeemInvitation(db, invite.InvitationId, &user); err != nil {
+		if errors.Is(err, errInvitationUsed) || errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired invitation"})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Username already exists"})
 		return
 	}
@@ -74,43 +87,83 @@ func Login(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	// Check if the user exists
+	// Refuse while the username or the client ip is backing off
+	if wait := services.LoginRetryAfter(db, input.Name, c.ClientIP()); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed logins, retry later"})
+		return
+	}
+
+	// Unknown users and wrong passwords get the same answer in the same time
 	var user models.ExUser
 	if err := db.Where("uname = ?", input.Name).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not exist"})
+		services.DummyCheckPassword(input.Password)
+		services.RecordLoginFailure(db, input.Name, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if !services.CheckPassword(user.Password, input.Password) {
+		services.RecordLoginFailure(db, input.Name, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	services.ResetLoginFailures(db, input.Name)
+
 	if !user.IsActive {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "user disabled"})
 		return
 	}
 
-	// Compare password
-	if user.Eid == 0 {
-		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password)); err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-			return
-		}
-	} else {
-		if user.Password != input.Password {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-			return
-		}
+	// Start a session and hand out the token pair, or ask for the second factor
+	completeLogin(c, db, user, models.SessionMethodPassword)
+}
+
+// LoginWithToken godoc
+// @Summary Log in with a login token
+// @Description Exchanges a token from a QR code or login link for a token pair
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param token body models.LoginTokenInput true "Login token"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /login/token [post]
+func LoginWithToken(c *gin.Context, db *gorm.DB) {
+	var input models.LoginTokenInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	// Generate JWT token
-	token, err := GenerateToken(user.Name, user.ID, user.Eid)
+	user, err := services.RedeemLoginToken(db, input.Token)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login token"})
+		return
+	}
+	if !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user disabled"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	completeLogin(c, db, *user, models.SessionMethodLoginToken)
 }
 
 // JWT Middleware to protect routes
-func AuthMiddleware() gin.HandlerFunc {
+func AuthMiddleware(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Machine clients authenticate with an API key instead of a JWT
+		if key := services.ApiKeyFromRequest(c); key != "" {
+			claims := services.ValidateApiKey(c, db, key)
+			if claims == nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired api key"})
+				c.Abort()
+				return
+			}
+			c.Set("user", claims)
+			c.Next()
+			return
+		}
+
 		tokenString := c.GetHeader("Authorization")
 		if tokenString == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization token required"})
@@ -126,6 +179,20 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// Reject tokens of revoked sessions
+		if !isSessionActive(db, claims.Sid) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "session revoked"})
+			c.Abort()
+			return
+		}
+
+		// Users with an initial password must change it before anything else
+		if claims.Mcp && c.FullPath() != "/api/password" && c.FullPath() != "/logout" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "password change required"})
+			c.Abort()
+			return
+		}
+
 		// Set the username in the context
 		c.Set("user", claims)
 		bs, _ := json.Marshal(&claims)
@@ -134,3 +201,51 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// ChangePassword godoc
+// @Summary Change the password of the current user
+// @Description Required after logging in with an initial password. All sessions of the user
+// @Description are revoked and a new token pair is returned.
+// @Tags auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param password body models.ChangePasswordInput true "Old and new password"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Router /api/password [post]
+func ChangePassword(c *gin.Context, db *gorm.DB) {
+	var input models.ChangePasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	claims := services.GetClaims(c)
+
+	var user models.ExUser
+	if err := db.First(&user, claims.UserId).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if !services.CheckPassword(user.Password, input.OldPassword) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if input.NewPassword == input.OldPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "new password must differ from the old one"})
+		return
+	}
+
+	hash, err := services.HashPassword(input.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+	if err := db.Model(&user).Updates(map[string]interface{}{"password": hash, "must_change_password": false}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	db.Model(&models.ExSession{}).Where("uid=?", user.ID).Update("is_active", false)
+	issueSession(c, db, user, models.SessionMethodPassword)
+}
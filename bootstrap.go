@@ -0,0 +1,157 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go-http-svc/models"
+	"go-http-svc/services"
+	"log"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+// createSuperAdmin creates a global super admin, with a generated
+// password when none is given.
+func createSuperAdmin(db *gorm.DB, uname, name, password string) (*models.ExUser, string, error) {
+	if password == "" {
+		password = services.GeneratePassword(12)
+	}
+	hash, err := services.HashPassword(password)
+	if err != nil {
+		return nil, "", err
+	}
+	if name == "" {
+		name = uname
+	}
+	user := models.ExUser{ExUserInput: models.ExUserInput{
+		Name:     name,
+		Uname:    uname,
+		Password: hash,
+		Role:     models.RoleSuperAdmin,
+	}}
+	if err := db.Create(&user).Error; err != nil {
+		return nil, "", err
+	}
+	return &user, password, nil
+}
+
+// runCommand handles the command line subcommands, returns false to start
+// the server.
+//
+//	create-admin -uname admin [-name Admin] [-password secret]
+//	export -eid 3 -o exibition-3.zip
+//	import -i exibition-3.zip
+//	fix-catalog-roots
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "create-admin":
+		fs := flag.NewFlagSet("create-admin", flag.ExitOnError)
+		uname := fs.String("uname", "", "login name")
+		name := fs.String("name", "", "display name, defaults to uname")
+		password := fs.String("password", "", "password, generated when empty")
+		fs.Parse(args[1:])
+		if *uname == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		user, pass, err := createSuperAdmin(db, *uname, *name, *password)
+		if err != nil {
+			log.Fatalf("Error creating admin: %v", err)
+		}
+		fmt.Printf("super admin %s created, id %d\n", user.Uname, user.ID)
+		if *password == "" {
+			fmt.Println("password:", pass)
+		}
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		eid := fs.Int("eid", 0, "exibition to export")
+		out := fs.String("o", "", "bundle file to write, exibition-<eid>.zip by default")
+		fs.Parse(args[1:])
+		if *eid == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if *out == "" {
+			*out = fmt.Sprintf("exibition-%d.zip", *eid)
+		}
+
+		bundle, err := services.LoadExibitionBundle(db, *eid)
+		if err != nil {
+			log.Fatalf("Error loading exibition %d: %v", *eid, err)
+		}
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Error creating %s: %v", *out, err)
+		}
+		if err := bundle.Write(f, "uploads"); err != nil {
+			log.Fatalf("Error writing %s: %v", *out, err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("Error writing %s: %v", *out, err)
+		}
+		fmt.Printf("exibition %d exported to %s\n", *eid, *out)
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		in := fs.String("i", "", "bundle file to import")
+		fs.Parse(args[1:])
+		if *in == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		zr, err := zip.OpenReader(*in)
+		if err != nil {
+			log.Fatalf("Error opening %s: %v", *in, err)
+		}
+		defer zr.Close()
+		ret, err := services.ImportExibitionBundle(db, &zr.Reader, "uploads")
+		if err != nil {
+			log.Fatalf("Error importing %s: %v", *in, err)
+		}
+		out, _ := json.MarshalIndent(ret, "", "  ")
+		fmt.Println(string(out))
+	case "fix-catalog-roots":
+		fixed, err := services.FixCatalogRoots(db)
+		if err != nil {
+			log.Fatalf("Error fixing catalog roots: %v", err)
+		}
+		fmt.Printf("root_id of %d catalogs fixed\n", fixed)
+	default:
+		log.Fatalf("unknown command %q", args[0])
+	}
+	return true
+}
+
+// bootstrapAdmin creates the first super admin on the first run from
+// BOOTSTRAP_ADMIN_UNAME / BOOTSTRAP_ADMIN_PASSWORD, nothing is done once
+// any super admin exists.
+func bootstrapAdmin() {
+	uname := os.Getenv("BOOTSTRAP_ADMIN_UNAME")
+	if uname == "" {
+		return
+	}
+	var count int64
+	db.Model(&models.ExUser{}).Where("role=?", models.RoleSuperAdmin).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	user, pass, err := createSuperAdmin(db, uname, "", os.Getenv("BOOTSTRAP_ADMIN_PASSWORD"))
+	if err != nil {
+		log.Fatalf("Error creating bootstrap admin: %v", err)
+	}
+	fmt.Printf("bootstrap super admin %s created, id %d\n", user.Uname, user.ID)
+	if os.Getenv("BOOTSTRAP_ADMIN_PASSWORD") == "" {
+		fmt.Println("password:", pass)
+	}
+}
@@ -0,0 +1,166 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package main
+
+import (
+	"errors"
+	"go-http-svc/models"
+	"go-http-svc/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+var errInvitationUsed = errors.New("invitation already used")
+
+// CreateInvitation godoc
+// @Summary Invite a new user
+// @Description Returns a signed token to hand to the invitee, who redeems it once with /register.
+// @Description eid 0 invites global super admins, other eids invite users of that exhibition.
+// @Tags invitation
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param eid path int true "Exibition ID"
+// @Param invitation body models.InvitationInput true "Role of the invitee"
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /api/{eid}/invitations [put]
+func CreateInvitation(c *gin.Context, db *gorm.DB) {
+	eid := services.GetEid(c)
+	var input models.InvitationInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !models.IsRoleOfEid(input.Role, eid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role for eid " + strconv.Itoa(eid)})
+		return
+	}
+	if !services.CanGrantRole(c, input.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "can not grant role " + input.Role})
+		return
+	}
+	if input.ExpiresIn <= 0 {
+		input.ExpiresIn = 72
+	}
+
+	invitation := models.ExInvitation{
+		Eid:       eid,
+		Role:      input.Role,
+		Note:      input.Note,
+		CreatedBy: services.GetClaims(c).UserId,
+		ExpiresAt: time.Now().Add(time.Duration(input.ExpiresIn) * time.Hour),
+	}
+	if result := db.Create(&invitation); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+
+	token, err := keyring.Sign(&models.InviteClaims{
+		InvitationId: invitation.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audienceInvite},
+			ExpiresAt: jwt.NewNumericDate(invitation.ExpiresAt),
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invitation": invitation, "token": token})
+}
+
+// GetInvitations godoc
+// @Summary List the invitations of an exhibition
+// @Tags invitation
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "Exibition ID"
+// @Success 200 {array} models.ExInvitation
+// @Router /api/{eid}/invitations [get]
+func GetInvitations(c *gin.Context, db *gorm.DB) {
+	var invitations []models.ExInvitation
+	if result := services.TenantDB(c, db).Order("id desc").Find(&invitations); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, invitations)
+}
+
+// RevokeInvitation godoc
+// @Summary Revoke an invitation not redeemed yet
+// @Tags invitation
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "Exibition ID"
+// @Param id path int true "Invitation ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/invitations/{id} [delete]
+func RevokeInvitation(c *gin.Context, db *gorm.DB) {
+	result := services.TenantDB(c, db).Model(&models.ExInvitation{}).
+		Where("id=? and redeemed_at is null", c.Param("id")).Update("is_active", false)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found or already used"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "invitation revoked"})
+}
+
+// redeemInvitation creates the invited user, marking the invitation used
+// in the same transaction so that a token only ever creates one user.
+func redeemInvitation(db *gorm.DB, invitationId int, user *models.ExUser) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var invitation models.ExInvitation
+		if err := tx.First(&invitation, invitationId).Error; err != nil {
+			return err
+		}
+		if !invitation.IsActive || invitation.RedeemedAt != nil || invitation.ExpiresAt.Before(time.Now()) {
+			return errInvitationUsed
+		}
+		// not into a deleted exhibition
+		if invitation.Eid != 0 {
+			if err := tx.First(&models.Exibition{}, invitation.Eid).Error; err != nil {
+				return err
+			}
+		}
+
+		user.Eid = invitation.Eid
+		user.Role = invitation.Role
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		result := tx.Model(&invitation).Where("redeemed_at is null").Updates(map[string]interface{}{
+			"redeemed_by": user.ID,
+			"redeemed_at": &now,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInvitationUsed
+		}
+		return nil
+	})
+}
+
+func parseInviteToken(tokenString string) (*models.InviteClaims, error) {
+	claims := &models.InviteClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyring.Keyfunc, jwt.WithAudience(audienceInvite))
+	if err != nil || !token.Valid {
+		return nil, err
+	}
+	return claims, nil
+}
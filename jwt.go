@@ -11,39 +11,42 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtSecret = []byte("0xfabefaffeaab")
+// audiences keep the tokens signed by the keyring from being used one for another
+const (
+	audienceAccess = "access"
+	audienceInvite = "invite"
+	audienceMfa    = "mfa"
+	audienceOidc   = "oidc"
+)
 
 // Generate JWT Token
-func GenerateToken(username string, uid, eid int) (string, error) {
-	// Set token expiration time
-	expirationTime := time.Now().Add(4 * 7 * 24 * time.Hour)
+func GenerateToken(user models.ExUser, sid string) (string, error) {
+	// Set token expiration time, short lived since the refresh token renews it
+	expirationTime := time.Now().Add(accessTokenTTL())
 	claims := &models.Claims{
-		Username: username,
-		UserId:   uid,
-		Eid:      eid,
+		Username: user.Name,
+		UserId:   user.ID,
+		Eid:      user.Eid,
+		Perms:    models.PermsOf(user.EffectiveRole()),
+		Sid:      sid,
+		Mcp:      user.MustChangePassword,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audienceAccess},
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	// Create the token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
-	if err != nil {
-		return "", err
-	}
-
-	return tokenString, nil
+	// Sign with the current key of the keyring
+	return keyring.Sign(claims)
 }
 
 // Validate JWT Token
 func ValidateToken(tokenString string) (*models.Claims, error) {
 	claims := &models.Claims{}
 
-	// Parse the token
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	// Parse the token, the key is picked by the kid header and the
+	// audience rejects the other tokens signed by the keyring
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyring.Keyfunc, jwt.WithAudience(audienceAccess))
 
 	if err != nil || !token.Valid {
 		return nil, err
@@ -0,0 +1,211 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is one entry of the keyring. Retired asymmetric keys may only
+// carry the public half, in which case private is nil.
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+// Keyring holds the key used to sign new tokens plus every key that is
+// still accepted when validating, indexed by kid.
+type Keyring struct {
+	current *signingKey
+	keys    map[string]*signingKey
+}
+
+var keyring *Keyring
+
+// initKeyring loads the JWT keys from the environment:
+//
+//	JWT_KEYS              HMAC keys, "kid:secret,kid:secret"
+//	JWT_KEY_FILES         PEM encoded RSA/Ed25519 keys, "kid:path,kid:path"
+//	JWT_SIGNING_KID       kid used to sign new tokens, defaults to the first
+//	                      key of JWT_KEY_FILES, then the first of JWT_KEYS
+//
+// Every other key is retired: still valid for verification, never used to sign.
+func initKeyring() {
+	kr, err := LoadKeyring(os.Getenv("JWT_KEYS"), os.Getenv("JWT_KEY_FILES"), os.Getenv("JWT_SIGNING_KID"))
+	if err != nil {
+		log.Fatalf("Error loading JWT keys: %v", err)
+	}
+	keyring = kr
+}
+
+func LoadKeyring(hmacKeys, keyFiles, signingKid string) (*Keyring, error) {
+	kr := &Keyring{keys: map[string]*signingKey{}}
+	var order []string
+
+	for _, entry := range splitList(keyFiles) {
+		kid, path, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" || path == "" {
+			return nil, fmt.Errorf("invalid JWT_KEY_FILES entry %q", entry)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read key %s: %w", kid, err)
+		}
+		key, err := parsePEMKey(kid, data)
+		if err != nil {
+			return nil, err
+		}
+		if err := kr.add(key); err != nil {
+			return nil, err
+		}
+		order = append(order, kid)
+	}
+
+	for i, entry := range splitList(hmacKeys) {
+		kid, secret, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("invalid JWT_KEYS entry #%d, expect kid:secret", i+1)
+		}
+		key := &signingKey{kid: kid, method: jwt.SigningMethodHS256, private: []byte(secret), public: []byte(secret)}
+		if err := kr.add(key); err != nil {
+			return nil, err
+		}
+		order = append(order, kid)
+	}
+
+	if len(order) == 0 {
+		return nil, errors.New("no keys configured, set JWT_KEYS or JWT_KEY_FILES")
+	}
+	if signingKid == "" {
+		signingKid = order[0]
+	}
+	current, ok := kr.keys[signingKid]
+	if !ok {
+		return nil, fmt.Errorf("signing kid %q not found", signingKid)
+	}
+	if current.private == nil {
+		return nil, fmt.Errorf("signing kid %q has no private key", signingKid)
+	}
+	kr.current = current
+
+	return kr, nil
+}
+
+func (kr *Keyring) add(key *signingKey) error {
+	if _, ok := kr.keys[key.kid]; ok {
+		return fmt.Errorf("duplicated kid %q", key.kid)
+	}
+	kr.keys[key.kid] = key
+	return nil
+}
+
+func parsePEMKey(kid string, data []byte) (*signingKey, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, private: key, public: &key.PublicKey}, nil
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, public: key}, nil
+	}
+	if key, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		priv := key.(ed25519.PrivateKey)
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, private: priv, public: priv.Public()}, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, public: key}, nil
+	}
+	return nil, fmt.Errorf("key %s: unsupported PEM, expect RSA or Ed25519", kid)
+}
+
+// Sign signs the claims with the current key and stamps its kid in the header.
+func (kr *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(kr.current.method, claims)
+	token.Header["kid"] = kr.current.kid
+	return token.SignedString(kr.current.private)
+}
+
+// Keyfunc resolves the verification key by kid. Tokens issued before kids
+// were introduced carry none and are refused.
+func (kr *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("missing kid")
+	}
+
+	key, ok := kr.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for kid %q", token.Method.Alg(), kid)
+	}
+	return key.public, nil
+}
+
+// JWKS returns the public half of every asymmetric key. HMAC secrets are
+// never published.
+func (kr *Keyring) JWKS() []gin.H {
+	keys := []gin.H{}
+	for _, key := range kr.keys {
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, gin.H{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": key.method.Alg(),
+				"kid": key.kid,
+				"n":   b64url(pub.N.Bytes()),
+				"e":   b64url(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, gin.H{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"use": "sig",
+				"alg": key.method.Alg(),
+				"kid": key.kid,
+				"x":   b64url(pub),
+			})
+		}
+	}
+	return keys
+}
+
+// JWKS godoc
+// @Summary Public keys used to sign tokens
+// @Description JSON Web Key Set of the RS256/EdDSA keys, empty when only HMAC keys are configured
+// @Tags auth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /.well-known/jwks.json [get]
+func JWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": keyring.JWKS()})
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func splitList(s string) []string {
+	var ret []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
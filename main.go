@@ -72,7 +72,42 @@ func initDB() {
 
 	// Auto-migrate the User model
 	db.AutoMigrate(&models.Exibition{}, &models.ExUser{}, &models.ExCatalog{},
-		&models.ExItem{}, &models.ExRate{}, &models.ExAmount{}, &models.ExComment{})
+		&models.ExItem{}, &models.ExRate{}, &models.ExAmount{}, &models.ExComment{},
+		&models.ExSession{}, &models.ExInvitation{}, &models.ExLoginToken{},
+		&models.ExLoginFailure{}, &models.ExApiKey{},
+		&models.ExItemResult{}, &models.ExibitionTransition{}, &models.ExAttrDef{})
+
+	// Passwords stored in plaintext before hashing was enforced
+	if err := services.MigratePlaintextPasswords(db); err != nil {
+		log.Fatalf("Error hashing plaintext passwords: %v", err)
+	}
+
+	// root_id of catalogs was left 0 below the top level before moves kept it right
+	if fixed, err := services.FixCatalogRoots(db); err != nil {
+		log.Fatalf("Error fixing catalog roots: %v", err)
+	} else if fixed > 0 {
+		log.Printf("Fixed the root of %d catalogs", fixed)
+	}
+
+	// catalogs and items were listed by creation before they had a sort order
+	if numbered, err := services.BackfillSorts(db); err != nil {
+		log.Fatalf("Error numbering catalogs and items: %v", err)
+	} else if numbered > 0 {
+		log.Printf("Numbered the catalogs or items of %d parents", numbered)
+	}
+
+	// Exibitions created before the lifecycle existed were all running
+	db.Model(&models.Exibition{}).Where("status is null or status=''").Update("status", models.ExibitionOpen)
+
+	// Only one exhibition is active, keep the one GetActiveExibition used to pick
+	var current models.Exibition
+	if db.Where("is_active=?", true).Order("update_time desc").First(&current).Error == nil {
+		db.Model(&models.Exibition{}).Where("is_active=? and id<>?", true, current.ID).Update("is_active", false)
+	}
+
+	// Users created before roles existed
+	db.Model(&models.ExUser{}).Where("role='' and eid=0").Update("role", models.RoleSuperAdmin)
+	db.Model(&models.ExUser{}).Where("role='' and eid<>0").Update("role", models.RoleJudge)
 }
 
 // @title Exibition System API
@@ -94,6 +129,13 @@ func main() {
 	}
 	// Initialize the database
 	initDB()
+	// subcommands like create-admin run instead of the server
+	if runCommand(os.Args[1:]) {
+		return
+	}
+	bootstrapAdmin()
+	initKeyring()
+	services.StartScheduler(db, envDuration("SCHEDULER_INTERVAL", time.Minute))
 
 	// Create a new Gin router
 	r := gin.Default()
@@ -109,6 +151,8 @@ func main() {
 	// Swagger endpoint
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
+	r.GET("/.well-known/jwks.json", JWKS)
+
 	r.POST("/register", func(c *gin.Context) {
 		Register(c, db)
 	})
@@ -117,189 +161,350 @@ func main() {
 	r.POST("/login", func(c *gin.Context) {
 		Login(c, db)
 	})
+	r.POST("/login/token", func(c *gin.Context) {
+		LoginWithToken(c, db)
+	})
+	r.POST("/login/totp", func(c *gin.Context) {
+		LoginTotp(c, db)
+	})
+	r.GET("/oidc/login", OidcLogin)
+	r.GET("/oidc/callback", func(c *gin.Context) {
+		OidcCallback(c, db)
+	})
+	r.POST("/refresh", func(c *gin.Context) {
+		Refresh(c, db)
+	})
+	r.POST("/logout", AuthMiddleware(db), func(c *gin.Context) {
+		Logout(c, db)
+	})
 	r.GET("/ex_active", func(c *gin.Context) {
 		services.GetActiveExibition(c, db)
 	})
 
 	router := r.Group("/api")
-	router.Use(AuthMiddleware())
+	router.Use(AuthMiddleware(db))
+
+	router.POST("/password", func(c *gin.Context) {
+		ChangePassword(c, db)
+	})
+
+	router.POST("/totp/enroll", func(c *gin.Context) {
+		services.EnrollTotp(c, db)
+	})
+	router.POST("/totp/verify", func(c *gin.Context) {
+		services.VerifyTotp(c, db)
+	})
+	router.POST("/totp/disable", func(c *gin.Context) {
+		services.DisableTotp(c, db)
+	})
 
 	// Set up routes
-	router.POST("/file_upload", func(c *gin.Context) {
+	router.POST("/file_upload", services.RequirePerm(models.PermFileUpload), func(c *gin.Context) {
 		services.UploadFile(c)
 	})
 	router.GET("/exibitions", func(c *gin.Context) {
 		services.GetExibitions(c, db)
 	})
-	router.PUT("/exibitions", func(c *gin.Context) {
+	router.PUT("/exibitions", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
 		services.CreateExibition(c, db)
 	})
+	router.PUT("/exibitions/import", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.ImportExibition(c, db)
+	})
 	router.GET("/exibitions/:id", func(c *gin.Context) {
 		services.GetExibition(c, db)
 	})
-	router.PATCH("/exibitions/:id", func(c *gin.Context) {
+	router.PATCH("/exibitions/:id", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
 		services.UpdateExibition(c, db)
 	})
-	router.DELETE("/exibitions/:id", func(c *gin.Context) {
+	router.DELETE("/exibitions/:id", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
 		services.DeleteExibition(c, db)
 	})
-	router.POST("/ex_active/:eid", func(c *gin.Context) {
+	router.POST("/exibitions/:id/status", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.SetExibitionStatus(c, db)
+	})
+	router.GET("/exibitions/:id/transitions", func(c *gin.Context) {
+		services.GetExibitionTransitions(c, db)
+	})
+	router.POST("/exibitions/:id/clone", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.CloneExibition(c, db)
+	})
+	router.GET("/exibitions/:id/export", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.ExportExibition(c, db)
+	})
+	router.PUT("/exibitions/:id/catalog_policy", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.SetCatalogPolicy(c, db)
+	})
+	router.POST("/ex_active/:eid", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
 		services.SetActiveExibition(c, db)
 	})
+	router.GET("/trash/exibitions", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.GetTrash(c, db)
+	})
+	router.POST("/trash/exibitions/:id/restore", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.RestoreTrash(c, db)
+	})
+	router.DELETE("/trash/exibitions/:id", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.PurgeTrash(c, db)
+	})
+	router.GET("/lockouts", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.GetLockouts(c, db)
+	})
+	router.DELETE("/lockouts/:id", services.RequirePerm(models.PermExibitionManage), func(c *gin.Context) {
+		services.DeleteLockout(c, db)
+	})
+	// exhibition scoped routes, see services.ExibitionScope
+	ex := router.Group("/:eid")
+	ex.Use(services.ExibitionScope(db))
+
 	//users
 
-	router.PUT("/:eid/users_tmpl", func(c *gin.Context) {
+	ex.PUT("/users_tmpl", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
 		services.CreateUserFromTemplate(c, db)
 	})
 
-	router.GET("/:eid/users", func(c *gin.Context) {
+	ex.GET("/users", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
 		services.GetExUsers(c, db)
 	})
-	router.POST("/:eid/users", func(c *gin.Context) {
+	ex.POST("/users", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
 		services.CreateExUser(c, db)
 	})
-	router.PUT("/:eid/users", func(c *gin.Context) {
+	ex.PUT("/users", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
 		services.BatchCreateExUser(c, db)
 	})
-	router.GET("/:eid/users/:id", func(c *gin.Context) {
+	ex.GET("/users/:id", func(c *gin.Context) {
 		services.GetExUser(c, db)
 	})
-	router.PATCH("/:eid/users/:id", func(c *gin.Context) {
+	ex.PATCH("/users/:id", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
 		services.UpdateExUser(c, db)
 	})
-	router.DELETE("/:eid/users/:id", func(c *gin.Context) {
+	ex.DELETE("/users/:id", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
 		services.DeleteExUser(c, db)
 	})
 
-	router.POST("/:eid/active_users", func(c *gin.Context) {
+	ex.GET("/users/:id/sessions", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.GetExUserSessions(c, db)
+	})
+	ex.DELETE("/users/:id/sessions", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.RevokeExUserSessions(c, db)
+	})
+
+	ex.DELETE("/users/:id/totp", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.ResetExUserTotp(c, db)
+	})
+
+	ex.GET("/users/:id/login_tokens", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.GetLoginTokens(c, db)
+	})
+	ex.POST("/users/:id/login_tokens", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.CreateLoginToken(c, db)
+	})
+	ex.DELETE("/users/:id/login_tokens", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.RevokeLoginTokens(c, db)
+	})
+	ex.POST("/login_sheet", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.GetLoginSheet(c, db)
+	})
+
+	ex.GET("/api_keys", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.GetApiKeys(c, db)
+	})
+	ex.PUT("/api_keys", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.CreateApiKey(c, db)
+	})
+	ex.DELETE("/api_keys/:id", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		services.RevokeApiKey(c, db)
+	})
+
+	ex.GET("/invitations", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		GetInvitations(c, db)
+	})
+	ex.PUT("/invitations", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		CreateInvitation(c, db)
+	})
+	ex.DELETE("/invitations/:id", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
+		RevokeInvitation(c, db)
+	})
+
+	ex.POST("/active_users", services.RequirePerm(models.PermUserManage), func(c *gin.Context) {
 		services.ActiveExUser(c, db)
 	})
 
 	//catalogs
-	router.GET("/:eid/catalogs", func(c *gin.Context) {
+	ex.GET("/catalogs", func(c *gin.Context) {
 		services.GetExCatalogs(c, db)
 	})
-	router.PUT("/:eid/catalogs", func(c *gin.Context) {
+	ex.PUT("/catalogs", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
 		services.CreateExCatalog(c, db)
 	})
-	router.GET("/:eid/catalogs/:id", func(c *gin.Context) {
+	ex.GET("/catalogs/:id", func(c *gin.Context) {
 		services.GetExCatalog(c, db)
 	})
-	router.PATCH("/:eid/catalogs/:id", func(c *gin.Context) {
+	ex.PATCH("/catalogs/:id", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
 		services.UpdateExCatalog(c, db)
 	})
-	router.DELETE("/:eid/catalogs/:id", func(c *gin.Context) {
+	ex.DELETE("/catalogs/:id", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
 		services.DeleteExCatalog(c, db)
 	})
+	ex.PUT("/catalogs/import", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
+		services.ImportExCatalogs(c, db)
+	})
+	ex.POST("/catalogs/reorder", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
+		services.ReorderExCatalogs(c, db)
+	})
+	ex.POST("/catalogs/:id/move", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
+		services.MoveExCatalog(c, db)
+	})
+	ex.GET("/catalogs/violations", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
+		services.GetPlacementViolations(c, db)
+	})
 
-	router.GET("/:eid/catalogs_root/:id", func(c *gin.Context) {
+	ex.GET("/catalogs_root/:id", func(c *gin.Context) {
 		services.GetExCatalogsRoot(c, db)
 	})
 
-	router.GET("/:eid/catalogs_path/:id", func(c *gin.Context) {
+	ex.GET("/catalogs_path/:id", func(c *gin.Context) {
 		services.GetExCatalogsPath(c, db)
 	})
 
-	router.GET("/:eid/sub_catalogs/:id", func(c *gin.Context) {
+	ex.GET("/sub_catalogs/:id", func(c *gin.Context) {
 		services.GetExCatalogsChildren(c, db)
 	})
 
+	ex.GET("/catalogs_tree", func(c *gin.Context) {
+		services.GetExCatalogsTree(c, db)
+	})
+
+	// Item attributes
+	ex.GET("/attrs", func(c *gin.Context) {
+		services.GetExAttrDefs(c, db)
+	})
+	ex.PUT("/attrs", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
+		services.CreateExAttrDef(c, db)
+	})
+	ex.PATCH("/attrs/:id", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
+		services.UpdateExAttrDef(c, db)
+	})
+	ex.DELETE("/attrs/:id", services.RequirePerm(models.PermCatalogWrite), func(c *gin.Context) {
+		services.DeleteExAttrDef(c, db)
+	})
+
 	// Item
-	router.GET("/:eid/items", func(c *gin.Context) {
+	ex.GET("/items", func(c *gin.Context) {
 		services.GetExItems(c, db)
 	})
 
-	router.GET("/:eid/items/:id", func(c *gin.Context) {
+	ex.GET("/items/:id", func(c *gin.Context) {
 		services.GetExItem(c, db)
 	})
 
-	router.PUT("/:eid/items", func(c *gin.Context) {
+	ex.PUT("/items", services.RequirePerm(models.PermItemWrite), func(c *gin.Context) {
 		services.CreateExItem(c, db)
 	})
-	router.PATCH("/:eid/items/:id", func(c *gin.Context) {
+	ex.PATCH("/items/:id", services.RequirePerm(models.PermItemWrite), func(c *gin.Context) {
 		services.UpdateExItem(c, db)
 	})
-	router.DELETE("/:eid/items/:id", func(c *gin.Context) {
+	ex.DELETE("/items/:id", services.RequirePerm(models.PermItemWrite), func(c *gin.Context) {
 		services.DeleteExItem(c, db)
 	})
+	ex.PUT("/items/import", services.RequirePerm(models.PermItemWrite), func(c *gin.Context) {
+		services.ImportExItems(c, db)
+	})
+	ex.POST("/items/reorder", services.RequirePerm(models.PermItemWrite), func(c *gin.Context) {
+		services.ReorderExItems(c, db)
+	})
 
-	// router.GET("/:eid/search_items", func(c *gin.Context) {
+	// ex.GET("/search_items", func(c *gin.Context) {
 	// 	services.SearchExItems(c, db)
 	// })
 
 	// Rate
-	router.GET("/:eid/rates/:id", func(c *gin.Context) {
+	ex.GET("/rates/:id", func(c *gin.Context) {
 		services.GetExRate(c, db)
 	})
-	router.PUT("/:eid/rates", func(c *gin.Context) {
+	ex.PUT("/rates", services.RequirePerm(models.PermRateWrite), services.RequireExibitionOpen(db), func(c *gin.Context) {
 		services.CreateExRate(c, db)
 	})
-	router.GET("/:eid/rate_item/:id/", func(c *gin.Context) {
+	ex.GET("/rate_item/:id/", func(c *gin.Context) {
 		services.GetMyRateByItemID(c, db)
 	})
-	router.GET("/:eid/rates_item/:id/", func(c *gin.Context) {
+	ex.GET("/rates_item/:id/", func(c *gin.Context) {
 		services.GetTotalRatesByItemID(c, db)
 	})
 
-	router.POST("/:eid/my_rates_items", func(c *gin.Context) {
+	ex.POST("/my_rates_items", func(c *gin.Context) {
 		services.GetMyRatesByItemIDs(c, db)
 	})
 
 	//Amount
-	router.GET("/:eid/amounts/:id", func(c *gin.Context) {
+	ex.GET("/amounts/:id", func(c *gin.Context) {
 		services.GetExAmount(c, db)
 	})
-	router.PUT("/:eid/amounts", func(c *gin.Context) {
+	ex.PUT("/amounts", services.RequirePerm(models.PermAmountWrite), services.RequireExibitionOpen(db), func(c *gin.Context) {
 		services.CreateExAmount(c, db)
 	})
-	router.GET("/:eid/amount_item/:id/", func(c *gin.Context) {
+	ex.GET("/amount_item/:id/", func(c *gin.Context) {
 		services.GetMyAmountByItemID(c, db)
 	})
-	router.GET("/:eid/amounts_item/:id/", func(c *gin.Context) {
+	ex.GET("/amounts_item/:id/", func(c *gin.Context) {
 		services.GetTotalAmountsByItemID(c, db)
 	})
 
 	// comment
-	router.GET("/:eid/comments/:id", func(c *gin.Context) {
+	ex.GET("/comments/:id", func(c *gin.Context) {
 		services.GetExComments(c, db)
 	})
 
-	router.PUT("/:eid/comments", func(c *gin.Context) {
+	ex.PUT("/comments", services.RequirePerm(models.PermCommentWrite), services.RequireExibitionOpen(db), func(c *gin.Context) {
 		services.CreateExComment(c, db)
 	})
 
+	// trash, the permission depends on the kind
+	ex.GET("/trash/:kind", func(c *gin.Context) {
+		services.GetTrash(c, db)
+	})
+	ex.POST("/trash/:kind/:id/restore", func(c *gin.Context) {
+		services.RestoreTrash(c, db)
+	})
+	ex.DELETE("/trash/:kind/:id", func(c *gin.Context) {
+		services.PurgeTrash(c, db)
+	})
+
 	// stats
-	router.GET("/:eid/stats/topn_rate_items/:topN", func(c *gin.Context) {
+	ex.GET("/stats/topn_rate_items/:topN", func(c *gin.Context) {
 		services.GetTopNRateItems(c, db)
 	})
-	router.GET("/:eid/stats/topn_amount_items/:topN", func(c *gin.Context) {
+	ex.GET("/stats/topn_amount_items/:topN", func(c *gin.Context) {
 		services.GetTopNAmountItems(c, db)
 	})
-	router.GET("/:eid/stats/topn_orders_items/:topN", func(c *gin.Context) {
+	ex.GET("/stats/topn_orders_items/:topN", func(c *gin.Context) {
 		services.GetTopNOrdersItems(c, db)
 	})
-	router.GET("/:eid/stats/items_rate_distribution", func(c *gin.Context) {
+	ex.GET("/stats/items_rate_distribution", func(c *gin.Context) {
 		services.GetItemsRateDistribution(c, db)
 	})
-	router.GET("/:eid/stats/num_amount_total", func(c *gin.Context) {
+	ex.GET("/stats/num_amount_total", func(c *gin.Context) {
 		services.GetTotalAmount(c, db)
 	})
-	router.GET("/:eid/stats/num_items_total", func(c *gin.Context) {
+	ex.GET("/stats/num_items_total", func(c *gin.Context) {
 		services.GetTotalItems(c, db)
 	})
-	router.GET("/:eid/stats/num_users_total", func(c *gin.Context) {
+	ex.GET("/stats/num_users_total", func(c *gin.Context) {
 		services.GetTotoalUsers(c, db)
 	})
-	router.GET("/:eid/stats/excellent_items/:rate", func(c *gin.Context) {
+	ex.GET("/stats/excellent_items/:rate", func(c *gin.Context) {
 		services.GetExcellentItems(c, db)
 	})
-	router.GET("/:eid/stats/catalog_trending", func(c *gin.Context) {
+	ex.GET("/stats/catalog_trending", func(c *gin.Context) {
 		services.GetCatalogTrending(c, db)
 	})
 
-	router.GET("/:eid/stats/orders_users_rate", func(c *gin.Context) {
+	ex.GET("/stats/orders_users_rate", func(c *gin.Context) {
 		services.GetOrdersRateOfUsers(c, db)
 	})
+	ex.GET("/results", func(c *gin.Context) {
+		services.GetExItemResults(c, db)
+	})
 
 	// Start the server
 	PORT := os.Getenv("PORT")
@@ -0,0 +1,88 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package main
+
+import (
+	"go-http-svc/models"
+	"go-http-svc/services"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// completeLogin starts the session of an authenticated user, unless TOTP
+// is enabled: the response is then a short lived mfa_token to be sent
+// with a code to /login/totp.
+func completeLogin(c *gin.Context, db *gorm.DB, user models.ExUser, method string) {
+	if !user.TotpEnabled {
+		issueSession(c, db, user, method)
+		return
+	}
+
+	token, err := keyring.Sign(&models.MfaClaims{
+		UserId: user.ID,
+		Method: method,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audienceMfa},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": token})
+}
+
+// LoginTotp godoc
+// @Summary Complete a login with the second factor
+// @Description mfa_token is returned by /login for users with TOTP enabled, code is the
+// @Description one of the authenticator app or a recovery code.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param login body models.MfaLoginInput true "mfa token and code"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 429 {object} map[string]interface{}
+// @Router /login/totp [post]
+func LoginTotp(c *gin.Context, db *gorm.DB) {
+	var input models.MfaLoginInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := &models.MfaClaims{}
+	token, err := jwt.ParseWithClaims(input.MfaToken, claims, keyring.Keyfunc, jwt.WithAudience(audienceMfa))
+	if err != nil || !token.Valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired mfa token"})
+		return
+	}
+	var user models.ExUser
+	if err := db.First(&user, claims.UserId).Error; err != nil || !user.IsActive || !user.TotpEnabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired mfa token"})
+		return
+	}
+
+	// codes are throttled like passwords
+	if wait := services.LoginRetryAfter(db, user.Uname, c.ClientIP()); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed logins, retry later"})
+		return
+	}
+	if !services.VerifySecondFactor(db, &user, input.Code) {
+		services.RecordLoginFailure(db, user.Uname, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+	services.ResetLoginFailures(db, user.Uname)
+
+	issueSession(c, db, user, claims.Method)
+}
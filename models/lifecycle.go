@@ -0,0 +1,79 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// Status of an Exibition. Rates, amounts and comments are only accepted
+// while it's open, the results are frozen into ExItemResult on close.
+const (
+	ExibitionDraft     = "draft"
+	ExibitionPublished = "published"
+	ExibitionOpen      = "open"
+	ExibitionClosed    = "closed"
+	ExibitionArchived  = "archived"
+)
+
+// ExibitionTransitions lists the statuses reachable from each status
+var ExibitionTransitions = map[string][]string{
+	ExibitionDraft:     {ExibitionPublished},
+	ExibitionPublished: {ExibitionDraft, ExibitionOpen},
+	ExibitionOpen:      {ExibitionClosed},
+	ExibitionClosed:    {ExibitionOpen, ExibitionArchived},
+	ExibitionArchived:  {},
+}
+
+func CanTransition(from, to string) bool {
+	return slices.Contains(ExibitionTransitions[from], to)
+}
+
+// ExibitionTransition records a change of status or of the current
+// exhibition, Uid is 0 for the scheduler
+type ExibitionTransition struct {
+	Base
+	Eid    int    `json:"eid" gorm:"index"`
+	Kind   string `json:"kind" gorm:"size:16"`
+	From   string `json:"from" gorm:"size:16"`
+	To     string `json:"to" gorm:"size:16"`
+	Uid    int    `json:"uid"`
+	Reason string `json:"reason"`
+}
+
+const (
+	TransitionStatus = "status"
+	TransitionActive = "active"
+)
+
+type ExibitionStatusInput struct {
+	Status string `json:"status" binding:"required"`
+}
+
+// ExItemResult is the snapshot of the results of an item taken when its
+// exhibition closes, reports read it instead of the live rates and amounts.
+type ExItemResult struct {
+	Base
+	Eid       int       `json:"eid" gorm:"index"`
+	Iid       int       `json:"iid" gorm:"index"`
+	Cid       int       `json:"cid"`
+	Name      string    `json:"name"`
+	AvgRate   float64   `json:"avg_rate"`
+	RateCount int       `json:"rate_count"`
+	SumAmount int       `json:"sum_amount"`
+	Orders    int       `json:"orders"`
+	Comments  int       `json:"comments"`
+	Rank      int       `json:"rank"`
+	FrozenAt  time.Time `json:"frozen_at"`
+}
+
+type CloneExibitionInput struct {
+	// defaults to the title of the source with " (copy)"
+	Title     string     `json:"title"`
+	Items     bool       `json:"items"`
+	Users     bool       `json:"users"`
+	StartTime *time.Time `json:"start_time"`
+	EndTime   *time.Time `json:"end_time"`
+}
@@ -11,11 +11,11 @@ import (
 )
 
 type Base struct {
-	ID         int       `json:"id" gorm:"primaryKey"`
-	CreateTime time.Time `json:"create_time" gorm:"autoCreateTime"`
-	UpdateTime time.Time `json:"update_time" gorm:"autoUpdateTime"`
-	IsDeleted  bool      `json:"is_deleted" gorm:"default:false"`
-	IsActive   bool      `json:"is_active" gorm:"default:true"`
+	ID         int        `json:"id" gorm:"primaryKey"`
+	CreateTime time.Time  `json:"create_time" gorm:"autoCreateTime"`
+	UpdateTime time.Time  `json:"update_time" gorm:"autoUpdateTime"`
+	IsDeleted  SoftDelete `json:"is_deleted" gorm:"default:false"`
+	IsActive   bool       `json:"is_active" gorm:"default:true"`
 }
 
 type UserLogin struct {
@@ -38,20 +38,68 @@ type ExibitionInput struct {
 type Exibition struct {
 	Base
 	ExibitionInput
+	CatalogPolicy
+	// see ExibitionTransitions, only changed through the status endpoint
+	Status string `json:"status" gorm:"size:16;index"`
+}
+
+// Item placements of a CatalogPolicy
+const (
+	// items only in catalogs without child catalogs, which then can't get any
+	ItemsInLeaves = "leaf"
+	ItemsAnywhere = "any"
+)
+
+// CatalogPolicy is where the catalogs and the items of an exhibition may
+// go, only changed through the catalog policy endpoint
+type CatalogPolicy struct {
+	// any by default, what exhibitions did before there was a policy
+	ItemPlacement string `json:"item_placement" gorm:"size:16;default:any"`
+	// levels of catalogs, 0 for no limit
+	MaxCatalogDepth int `json:"max_catalog_depth" gorm:"default:0"`
+}
+
+func (p CatalogPolicy) LeafOnly() bool {
+	return p.ItemPlacement == ItemsInLeaves
 }
 
 type ExUserInput struct {
-	Eid      int    `json:"eid,omitempty" gorm:"index"`
-	Name     string `json:"name"`
-	Uname    string `json:"uname" gorm:"unique"`
-	Password string `json:"password"`
+	Eid  int    `json:"eid,omitempty" gorm:"index"`
+	Name string `json:"name"`
+	// unique among the users not deleted, see ExUser.Live
+	Uname    string `json:"uname" gorm:"size:191;uniqueIndex:idx_ex_users_uname,priority:1"`
+	Password string `json:"password,omitempty"`
 	Title    string `json:"title"`
 	Mobile   string `json:"mobile"`
+	Role     string `json:"role" gorm:"size:32"`
+	Email    string `json:"email" gorm:"size:191;index"`
 }
 
 type ExUser struct {
 	Base
 	ExUserInput
+	MustChangePassword bool `json:"must_change_password" gorm:"default:false"`
+	// plaintext of a freshly generated password, only ever sent once
+	InitialPassword string `json:"initial_password,omitempty" gorm:"-"`
+	TotpEnabled     bool   `json:"totp_enabled" gorm:"default:false"`
+	TotpSecret      string `json:"-" gorm:"size:64"`
+	// last accepted TOTP time step, codes up to it are refused
+	TotpCounter int64 `json:"-"`
+	// sha256 of the unused recovery codes, comma separated
+	RecoveryCodes string `json:"-" gorm:"type:text"`
+	// issuer and subject of the OpenID Connect identity linked to the user
+	OidcSubject string `json:"-" gorm:"size:191;index"`
+	// 1 unless deleted, NULL for deleted users so that their uname is free
+	// again in idx_ex_users_uname. Only ever computed by the database.
+	Live *bool `json:"-" gorm:"->:false;type:tinyint(1) GENERATED ALWAYS AS (IF(is_deleted, NULL, 1)) VIRTUAL;uniqueIndex:idx_ex_users_uname,priority:2"`
+}
+
+// MarshalJSON leaves the password hash out of every response
+func (u ExUser) MarshalJSON() ([]byte, error) {
+	type exUser ExUser
+	user := exUser(u)
+	user.Password = ""
+	return json.Marshal(user)
 }
 
 type ExCatalogInput struct {
@@ -70,6 +118,8 @@ type ExCatalog struct {
 	Base
 	ExCatalogInput
 	RootId int `json:"root_id"`
+	// position among the catalogs of the same parent, set by the reorder endpoint
+	Sort int `json:"sort" gorm:"default:0"`
 }
 
 // Claims struct
@@ -78,9 +128,162 @@ type Claims struct {
 	UserId   int    `json:"user_id"`
 	Eid      int    `json:"eid"`
 	Perms    string `json:"perms"`
+	Sid      string `json:"sid,omitempty"`
+	// must change password, only /api/password is allowed
+	Mcp bool `json:"mcp,omitempty"`
+	// set instead of UserId/Sid when authenticated by an ExApiKey
+	ApiKey int `json:"api_key,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// ExSession is a login of an user, the refresh token rotates on every use
+// and revoking the session invalidates all access tokens carrying its sid.
+type ExSession struct {
+	Base
+	Sid           string    `json:"sid" gorm:"uniqueIndex;size:64"`
+	Uid           int       `json:"uid" gorm:"index"`
+	Eid           int       `json:"eid"`
+	TokenHash     string    `json:"-" gorm:"index;size:64"`
+	PrevTokenHash string    `json:"-" gorm:"index;size:64"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	UserAgent     string    `json:"user_agent"`
+	Ip            string    `json:"ip"`
+	// how the user logged in, see SessionMethod*
+	Method string `json:"method" gorm:"size:16"`
+}
+
+const (
+	SessionMethodPassword   = "password"
+	SessionMethodLoginToken = "login_token"
+	SessionMethodOidc       = "oidc"
+)
+
+// ExLoginToken lets an user log in without typing credentials, eg. by
+// scanning a QR code. Only the hash of the token is stored.
+type ExLoginToken struct {
+	Base
+	Eid       int        `json:"eid" gorm:"index"`
+	Uid       int        `json:"uid" gorm:"index"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex;size:64"`
+	SingleUse bool       `json:"single_use"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedBy int        `json:"created_by"`
+}
+
+type LoginTokenInput struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// ExLoginFailure counts the failed logins of an username or of a client
+// ip, the login is refused until LockedUntil.
+type ExLoginFailure struct {
+	Base
+	Kind        string    `json:"kind" gorm:"size:8;uniqueIndex:idx_login_failure"`
+	Key         string    `json:"key" gorm:"size:191;uniqueIndex:idx_login_failure"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+const (
+	LoginFailureUser = "user"
+	LoginFailureIp   = "ip"
+)
+
+type TotpInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// MfaClaims is the payload of the token returned by a login that still
+// needs the second factor
+type MfaClaims struct {
+	UserId int    `json:"user_id"`
+	Method string `json:"method"`
 	jwt.RegisteredClaims
 }
 
+type MfaLoginInput struct {
+	MfaToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// ExApiKey authenticates a machine client in place of an user, with the
+// permissions Perms on exhibition Eid. Only the hash of the key is stored,
+// Prefix identifies it in listings.
+type ExApiKey struct {
+	Base
+	Eid        int        `json:"eid" gorm:"index"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix" gorm:"size:16"`
+	KeyHash    string     `json:"-" gorm:"uniqueIndex;size:64"`
+	Perms      string     `json:"perms"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIp string     `json:"last_used_ip"`
+	CreatedBy  int        `json:"created_by"`
+}
+
+type ApiKeyInput struct {
+	Name  string   `json:"name" binding:"required"`
+	Perms []string `json:"perms"`
+	// validity in days, never expires when 0
+	ExpiresIn int `json:"expires_in"`
+}
+
+type InvitationInput struct {
+	Role string `json:"role" binding:"required"`
+	Note string `json:"note"`
+	// validity in hours, 72 by default
+	ExpiresIn int `json:"expires_in"`
+}
+
+// OidcStateClaims is the payload of the cookie carrying the state of an
+// OpenID Connect login between the redirect and the callback
+type OidcStateClaims struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	jwt.RegisteredClaims
+}
+
+// ExInvitation onboards a new user of exhibition Eid with Role, the signed
+// token handed out refers to it by id and is redeemed at most once.
+type ExInvitation struct {
+	Base
+	Eid        int        `json:"eid" gorm:"index"`
+	Role       string     `json:"role" gorm:"size:32"`
+	Note       string     `json:"note"`
+	CreatedBy  int        `json:"created_by"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RedeemedBy int        `json:"redeemed_by"`
+	RedeemedAt *time.Time `json:"redeemed_at"`
+}
+
+// InviteClaims is the payload of an invitation token
+type InviteClaims struct {
+	InvitationId int `json:"invitation_id"`
+	jwt.RegisteredClaims
+}
+
+type RegisterInput struct {
+	Token    string `json:"token" binding:"required"`
+	Name     string `json:"name" binding:"required"`
+	Uname    string `json:"uname" binding:"required"`
+	Password string `json:"password" binding:"required,min=8"`
+	Title    string `json:"title"`
+	Mobile   string `json:"mobile"`
+}
+
+type ChangePasswordInput struct {
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=8"`
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
 type BatchUserInput struct {
 	NamePrefix string `json:"name_prefix"`
 	IndexRange []int  `json:"index_range" binding:"required,gt=1,dive"`
@@ -120,14 +323,49 @@ type ExItemInput struct {
 	Images      json.RawMessage `json:"images" gorm:"type:json"`
 	Videos      json.RawMessage `json:"videos" gorm:"type:json"`
 	Cid         int             `json:"cid"`
+	// extra attributes, a JSON object checked against the ExAttrDefs of the
+	// exhibition, keys without one are kept as they are
+	Attrs json.RawMessage `json:"attrs" gorm:"type:json"`
 }
 
 type ExItem struct {
 	Base
 	ExItemInput
+	// position among the items of the same catalog, set by the reorder endpoint
+	Sort int `json:"sort" gorm:"default:0"`
 	//Catalog ExCatalog `json:"catalog" gorm:"foreignKey:Cid;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
 }
 
+// Types of an ExAttrDef
+const (
+	AttrString = "string"
+	AttrNumber = "number"
+	// one of Options
+	AttrEnum = "enum"
+	AttrBool = "bool"
+	// YYYY-MM-DD
+	AttrDate = "date"
+)
+
+type ExAttrDefInput struct {
+	Eid int `json:"eid" gorm:"index"`
+	// top level catalog whose subtree has the attribute, 0 for all the items
+	Rid int `json:"rid" gorm:"default:0"`
+	// key in ExItem.Attrs, unique in the exhibition
+	Key      string          `json:"key" gorm:"size:64" binding:"required"`
+	Name     string          `json:"name"`
+	Type     string          `json:"type" gorm:"size:16" binding:"required"`
+	Required bool            `json:"required"`
+	Options  json.RawMessage `json:"options" gorm:"type:json"`
+	Sort     int             `json:"sort" gorm:"default:0"`
+}
+
+// ExAttrDef is a typed attribute of the items of an exhibition
+type ExAttrDef struct {
+	Base
+	ExAttrDefInput
+}
+
 type ExCommentInput struct {
 	Eid     int    `json:"eid"`
 	Uid     int    `json:"uid" gorm:"uniqueIndex:idx_cmt_user_per_item"`
@@ -0,0 +1,92 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package models
+
+import (
+	"slices"
+	"strings"
+)
+
+// Roles of an ExUser
+const (
+	RoleSuperAdmin     = "super-admin"
+	RoleExibitionAdmin = "exhibition-admin"
+	RoleJudge          = "judge"
+	RoleBuyer          = "buyer"
+	RoleViewer         = "viewer"
+)
+
+// Permissions carried by the token in Claims.Perms, comma separated
+const (
+	PermExibitionManage = "exibition:manage"
+	PermUserManage      = "user:manage"
+	PermCatalogWrite    = "catalog:write"
+	PermItemWrite       = "item:write"
+	PermFileUpload      = "file:upload"
+	PermRateWrite       = "rate:write"
+	PermAmountWrite     = "amount:write"
+	PermCommentWrite    = "comment:write"
+)
+
+var RolePerms = map[string][]string{
+	RoleSuperAdmin: {
+		PermExibitionManage, PermUserManage, PermCatalogWrite, PermItemWrite, PermFileUpload,
+		PermRateWrite, PermAmountWrite, PermCommentWrite,
+	},
+	RoleExibitionAdmin: {
+		PermUserManage, PermCatalogWrite, PermItemWrite, PermFileUpload,
+		PermRateWrite, PermAmountWrite, PermCommentWrite,
+	},
+	RoleJudge:  {PermRateWrite, PermAmountWrite, PermCommentWrite},
+	RoleBuyer:  {PermAmountWrite, PermCommentWrite},
+	RoleViewer: {},
+}
+
+func IsValidRole(role string) bool {
+	_, ok := RolePerms[role]
+	return ok
+}
+
+// DefaultRole is the role of users created before roles existed:
+// global users (eid 0) were the admins, the rest judges.
+func DefaultRole(eid int) string {
+	if eid == 0 {
+		return RoleSuperAdmin
+	}
+	return RoleJudge
+}
+
+// IsRoleOfEid tells whether role fits an user of exhibition eid: super
+// admins are global (eid 0), every other role belongs to an exhibition
+func IsRoleOfEid(role string, eid int) bool {
+	return IsValidRole(role) && (eid == 0) == (role == RoleSuperAdmin)
+}
+
+// RoleOfEid returns role when it fits eid, DefaultRole(eid) otherwise
+func RoleOfEid(role string, eid int) string {
+	if IsRoleOfEid(role, eid) {
+		return role
+	}
+	return DefaultRole(eid)
+}
+
+// EffectiveRole falls back to DefaultRole for users without a stored role
+func (u *ExUser) EffectiveRole() string {
+	if IsValidRole(u.Role) {
+		return u.Role
+	}
+	return DefaultRole(u.Eid)
+}
+
+func IsValidPerm(perm string) bool {
+	return slices.Contains(RolePerms[RoleSuperAdmin], perm)
+}
+
+func PermsOf(role string) string {
+	return strings.Join(RolePerms[role], ",")
+}
+
+func (c *Claims) HasPerm(perm string) bool {
+	return slices.Contains(strings.Split(c.Perms, ","), perm)
+}
@@ -0,0 +1,152 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// SoftDelete is the type of Base.IsDeleted, it makes deletes soft like
+// gorm.DeletedAt does: Delete sets is_deleted instead of removing the row,
+// and queries and updates of models skip the deleted rows. Use Unscoped to
+// see them or to really delete them.
+//
+// Raw SQL, joined tables and Table() queries scanned into other structs
+// aren't covered and must filter is_deleted themselves.
+type SoftDelete bool
+
+func (sd *SoftDelete) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*sd = false
+	case bool:
+		*sd = SoftDelete(v)
+	case int64:
+		*sd = v != 0
+	case []byte:
+		*sd = len(v) > 0 && string(v) != "0"
+	default:
+		return fmt.Errorf("can not scan %T into SoftDelete", value)
+	}
+	return nil
+}
+
+func (sd SoftDelete) Value() (driver.Value, error) {
+	return bool(sd), nil
+}
+
+func (SoftDelete) QueryClauses(f *schema.Field) []clause.Interface {
+	return []clause.Interface{softDeleteQueryClause{Field: f}}
+}
+
+type softDeleteQueryClause struct {
+	Field *schema.Field
+}
+
+func (sd softDeleteQueryClause) Name() string {
+	return ""
+}
+
+func (sd softDeleteQueryClause) Build(clause.Builder) {
+}
+
+func (sd softDeleteQueryClause) MergeClause(*clause.Clause) {
+}
+
+func (sd softDeleteQueryClause) ModifyStatement(stmt *gorm.Statement) {
+	if _, ok := stmt.Clauses["soft_delete_flag"]; ok || stmt.Statement.Unscoped {
+		return
+	}
+	// a single OR condition would otherwise swallow the filter, see gorm.SoftDeleteQueryClause
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok && len(where.Exprs) >= 1 {
+			for _, expr := range where.Exprs {
+				if orCond, ok := expr.(clause.OrConditions); ok && len(orCond.Exprs) == 1 {
+					where.Exprs = []clause.Expression{clause.And(where.Exprs...)}
+					c.Expression = where
+					stmt.Clauses["WHERE"] = c
+					break
+				}
+			}
+		}
+	}
+
+	stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: sd.Field.DBName}, Value: false},
+	}})
+	stmt.Clauses["soft_delete_flag"] = clause.Clause{}
+}
+
+func (SoftDelete) UpdateClauses(f *schema.Field) []clause.Interface {
+	return []clause.Interface{softDeleteUpdateClause{Field: f}}
+}
+
+type softDeleteUpdateClause struct {
+	Field *schema.Field
+}
+
+func (sd softDeleteUpdateClause) Name() string {
+	return ""
+}
+
+func (sd softDeleteUpdateClause) Build(clause.Builder) {
+}
+
+func (sd softDeleteUpdateClause) MergeClause(*clause.Clause) {
+}
+
+func (sd softDeleteUpdateClause) ModifyStatement(stmt *gorm.Statement) {
+	if stmt.SQL.Len() == 0 && !stmt.Statement.Unscoped {
+		softDeleteQueryClause(sd).ModifyStatement(stmt)
+	}
+}
+
+func (SoftDelete) DeleteClauses(f *schema.Field) []clause.Interface {
+	return []clause.Interface{softDeleteDeleteClause{Field: f}}
+}
+
+type softDeleteDeleteClause struct {
+	Field *schema.Field
+}
+
+func (sd softDeleteDeleteClause) Name() string {
+	return ""
+}
+
+func (sd softDeleteDeleteClause) Build(clause.Builder) {
+}
+
+func (sd softDeleteDeleteClause) MergeClause(*clause.Clause) {
+}
+
+// ModifyStatement turns the DELETE into an UPDATE of is_deleted, and of
+// update_time which then tells when the row was deleted
+func (sd softDeleteDeleteClause) ModifyStatement(stmt *gorm.Statement) {
+	if stmt.SQL.Len() > 0 || stmt.Statement.Unscoped {
+		return
+	}
+	set := clause.Set{{Column: clause.Column{Name: sd.Field.DBName}, Value: true}}
+	stmt.SetColumn(sd.Field.DBName, true, true)
+	if f := stmt.Schema.LookUpField("update_time"); f != nil {
+		now := stmt.DB.NowFunc()
+		set = append(set, clause.Assignment{Column: clause.Column{Name: f.DBName}, Value: now})
+		stmt.SetColumn(f.DBName, now, true)
+	}
+	stmt.AddClause(set)
+
+	_, queryValues := schema.GetIdentityFieldValuesMap(stmt.Context, stmt.ReflectValue, stmt.Schema.PrimaryFields)
+	column, values := schema.ToQueryValues(stmt.Table, stmt.Schema.PrimaryFieldDBNames, queryValues)
+	if len(values) > 0 {
+		stmt.AddClause(clause.Where{Exprs: []clause.Expression{clause.IN{Column: column, Values: values}}})
+	}
+
+	softDeleteQueryClause(sd).ModifyStatement(stmt)
+	stmt.AddClauseIfNotExists(clause.Update{})
+	stmt.Build(stmt.DB.Callback().Update().Clauses...)
+}
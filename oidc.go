@@ -0,0 +1,245 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package main
+
+import (
+	"context"
+	"errors"
+	"go-http-svc/models"
+	"go-http-svc/services"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// OpenID Connect login, configured from the environment:
+//
+//	OIDC_ISSUER           issuer url, discovery is done from it
+//	OIDC_CLIENT_ID        client registered at the provider
+//	OIDC_CLIENT_SECRET    its secret, empty for public clients
+//	OIDC_REDIRECT_URL     the url of /oidc/callback as seen by the browser
+//	OIDC_SCOPES           defaults to "openid email profile"
+//
+// The provider is discovered on the first login and not at startup, so an
+// unreachable provider only breaks OIDC logins.
+type oidcClient struct {
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	issuer   string
+}
+
+var (
+	oidcMu     sync.Mutex
+	oidcCached *oidcClient
+)
+
+// oidcHTTPClient talks to the provider, nil for http.DefaultClient. Set it
+// to reach a provider needing its own transport, eg. a local mock one.
+var oidcHTTPClient *http.Client
+
+const oidcCookie = "oidc_state"
+
+var errOidcNoAccount = errors.New("no account linked to this identity, ask an admin to set your email")
+
+// oidcContext makes discovery, the code exchange and the key fetches go
+// through oidcHTTPClient
+func oidcContext(ctx context.Context) context.Context {
+	if oidcHTTPClient == nil {
+		return ctx
+	}
+	ctx = oidc.ClientContext(ctx, oidcHTTPClient)
+	return context.WithValue(ctx, oauth2.HTTPClient, oidcHTTPClient)
+}
+
+// newOidcClient discovers the provider at issuer
+func newOidcClient(ctx context.Context, issuer string, config oauth2.Config) (*oidcClient, error) {
+	provider, err := oidc.NewProvider(oidcContext(ctx), issuer)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	config.Endpoint = provider.Endpoint()
+	return &oidcClient{
+		config:   config,
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		issuer:   issuer,
+	}, nil
+}
+
+// getOidcClient returns the client configured from the environment, set
+// oidcCached to use another one
+func getOidcClient(ctx context.Context) (*oidcClient, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcCached != nil {
+		return oidcCached, nil
+	}
+
+	client, err := newOidcClient(ctx, os.Getenv("OIDC_ISSUER"), oauth2.Config{
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	oidcCached = client
+	return oidcCached, nil
+}
+
+func oidcEnabled(c *gin.Context) bool {
+	if os.Getenv("OIDC_ISSUER") == "" || os.Getenv("OIDC_CLIENT_ID") == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "oidc login not configured"})
+		return false
+	}
+	return true
+}
+
+// OidcLogin godoc
+// @Summary Start an OpenID Connect login
+// @Description Redirects to the identity provider, which comes back to /oidc/callback
+// @Tags auth
+// @Success 302
+// @Router /oidc/login [get]
+func OidcLogin(c *gin.Context) {
+	if !oidcEnabled(c) {
+		return
+	}
+	client, err := getOidcClient(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "oidc discovery failed: " + err.Error()})
+		return
+	}
+
+	// state, nonce and PKCE verifier travel in a signed short lived cookie
+	state := models.OidcStateClaims{
+		State:    services.RandomToken(16),
+		Nonce:    services.RandomToken(16),
+		Verifier: oauth2.GenerateVerifier(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audienceOidc},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(10 * time.Minute)),
+		},
+	}
+	cookie, err := keyring.Sign(&state)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	secure := strings.HasPrefix(client.config.RedirectURL, "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcCookie, cookie, 600, "/oidc", "", secure, true)
+
+	c.Redirect(http.StatusFound, client.config.AuthCodeURL(state.State,
+		oidc.Nonce(state.Nonce), oauth2.S256ChallengeOption(state.Verifier)))
+}
+
+// OidcCallback godoc
+// @Summary Complete an OpenID Connect login
+// @Description Exchanges the authorization code, verifies the id token and starts a session
+// @Description for the user linked to the identity, see the README on account linking.
+// @Tags auth
+// @Produce json
+// @Param code query string true "authorization code"
+// @Param state query string true "state"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Failure 403 {object} map[string]interface{}
+// @Router /oidc/callback [get]
+func OidcCallback(c *gin.Context, db *gorm.DB) {
+	if !oidcEnabled(c) {
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc login failed: " + e})
+		return
+	}
+	client, err := getOidcClient(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "oidc discovery failed: " + err.Error()})
+		return
+	}
+
+	cookie, _ := c.Cookie(oidcCookie)
+	c.SetCookie(oidcCookie, "", -1, "/oidc", "", false, true)
+	state := &models.OidcStateClaims{}
+	token, err := jwt.ParseWithClaims(cookie, state, keyring.Keyfunc, jwt.WithAudience(audienceOidc))
+	if err != nil || !token.Valid || state.State != c.Query("state") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid oidc state"})
+		return
+	}
+
+	ctx := oidcContext(c.Request.Context())
+	oauth2Token, err := client.config.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc code exchange failed: " + err.Error()})
+		return
+	}
+	rawIdToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "no id_token in the oidc response"})
+		return
+	}
+	idToken, err := client.verifier.Verify(ctx, rawIdToken)
+	if err != nil || idToken.Nonce != state.Nonce {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid id_token"})
+		return
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid id_token claims"})
+		return
+	}
+
+	user, err := oidcUser(db, client.issuer+"|"+idToken.Subject, claims.Email, claims.EmailVerified)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user disabled"})
+		return
+	}
+
+	// the second factor applies to every way of logging in
+	completeLogin(c, db, *user, models.SessionMethodOidc)
+}
+
+// oidcUser finds the user linked to the identity. Identities are linked on
+// their first login to the single user having the same verified email.
+func oidcUser(db *gorm.DB, subject, email string, emailVerified bool) (*models.ExUser, error) {
+	var user models.ExUser
+	if err := db.Where("oidc_subject=?", subject).First(&user).Error; err == nil {
+		return &user, nil
+	}
+	if email == "" || !emailVerified {
+		return nil, errOidcNoAccount
+	}
+
+	var users []models.ExUser
+	db.Where("email=? and (oidc_subject is null or oidc_subject='')", email).Limit(2).Find(&users)
+	if len(users) != 1 {
+		return nil, errOidcNoAccount
+	}
+	user = users[0]
+	result := db.Model(&user).Where("oidc_subject is null or oidc_subject=''").Update("oidc_subject", subject)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, errOidcNoAccount
+	}
+	return &user, nil
+}
@@ -4,14 +4,22 @@
 package services
 
 import (
+	"encoding/json"
 	"go-http-svc/models"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
+func IsItemExists(db *gorm.DB, iid int) bool {
+	var count int64
+	db.Model(&models.ExItem{}).Where("id=?", iid).Count(&count)
+	return count > 0
+}
+
 // GetItems godoc
 // @Summary Get all items
 // @Description Get all items as an array
@@ -21,28 +29,38 @@ import (
 // @Param eid path int true "models.Exibition ID"
 // @Param q query string false "full body search string in name/description"
 // @Param cid query int false "catalog id"
+// @Param attrs query object false "attrs[key]=value, items with the attribute equal to value"
+// @Param attrs_min query object false "attrs_min[key]=value, items with the attribute at least value"
+// @Param attrs_max query object false "attrs_max[key]=value, items with the attribute at most value"
+// @Param sort query string false "key of an attribute to sort on, -key for descending"
 // @Success 200 {array} map[string]interface{}
 // @Router /api/{eid}/items [get]
 func GetExItems(c *gin.Context, db *gorm.DB) {
-	eid := c.Param("eid")
+	eid := GetEid(c)
 	q := c.Query("q")
 	if q != "" {
 		q = "%" + q + "%"
 	}
 
 	cid, _ := strconv.Atoi(c.Query("cid"))
+	schema, err := loadAttrSchema(TenantDB(c, db), eid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	var childIDs []int
 
 	db.Raw(`
 		WITH RECURSIVE child_tree AS (
-			SELECT id FROM ex_catalogs WHERE pid = ?
+			SELECT id FROM ex_catalogs WHERE pid = ? and eid = ? and is_deleted = false
 			UNION ALL
 			SELECT n.id FROM ex_catalogs n
 			INNER JOIN child_tree ct ON n.pid = ct.id
+			WHERE n.eid = ? and n.is_deleted = false
 		)
 		SELECT id FROM child_tree;
-	`, cid).Debug().Scan(&childIDs)
+	`, cid, eid, eid).Debug().Scan(&childIDs)
 	childIDs = append(childIDs, cid)
 
 	var results []struct {
@@ -52,13 +70,48 @@ func GetExItems(c *gin.Context, db *gorm.DB) {
 		SumAmount int     `json:"sum_amount"`
 	}
 
-	query := db.Table("ex_items").
+	query := TenantDB(c, db).Table("ex_items").
 		Select("ex_items.*, ex_catalogs.name as cname, AVG(ex_rates.rate) as avg_rate, SUM(ex_amounts.amount) as sum_amount").
-		Joins("LEFT JOIN ex_rates ON ex_rates.iid = ex_items.id and ex_rates.eid=ex_items.eid").
-		Joins("LEFT JOIN ex_amounts ON ex_amounts.iid = ex_items.id and ex_amounts.eid=ex_items.eid").
-		Joins("LEFT JOIN ex_catalogs ON ex_items.cid = ex_catalogs.id and ex_catalogs.eid=ex_items.eid").
-		Group("ex_items.id").
-		Where("ex_items.eid=? ", eid).Order("ex_items.id desc")
+		Joins("LEFT JOIN ex_rates ON ex_rates.iid = ex_items.id and ex_rates.eid=ex_items.eid and ex_rates.is_deleted = false").
+		Joins("LEFT JOIN ex_amounts ON ex_amounts.iid = ex_items.id and ex_amounts.eid=ex_items.eid and ex_amounts.is_deleted = false").
+		Joins("LEFT JOIN ex_catalogs ON ex_items.cid = ex_catalogs.id and ex_catalogs.eid=ex_items.eid and ex_catalogs.is_deleted = false").
+		Where("ex_items.is_deleted = false").
+		Group("ex_items.id")
+	// sort is the position among the items of the same catalog
+	order := "ex_items.cid, ex_items.sort, ex_items.id desc"
+	if key := c.Query("sort"); key != "" {
+		desc := strings.HasPrefix(key, "-")
+		def := schema.find(strings.TrimPrefix(key, "-"))
+		if def == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown attribute " + key})
+			return
+		}
+		if desc {
+			order = attrColumn(def) + " desc, " + order
+		} else {
+			order = attrColumn(def) + ", " + order
+		}
+	}
+	query = query.Order(order)
+	for param, op := range map[string]string{"attrs": "=", "attrs_min": ">=", "attrs_max": "<="} {
+		for key, text := range c.QueryMap(param) {
+			def := schema.find(key)
+			if def == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unknown attribute " + key})
+				return
+			}
+			if op != "=" && def.Type == models.AttrBool {
+				c.JSON(http.StatusBadRequest, gin.H{"error": key + " has no range"})
+				return
+			}
+			value, err := attrValue(def, text)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			query = query.Where(attrColumn(def)+" "+op+" ?", value)
+		}
+	}
 	if cid > 0 {
 		query = query.Where("ex_items.cid in ?", childIDs)
 	}
@@ -81,23 +134,31 @@ func GetExItems(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExItem
 // @Router /api/{eid}/items [put]
 func CreateExItem(c *gin.Context, db *gorm.DB) {
-	eid := c.Param("eid")
 	var input models.ExItemInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	input.Eid, _ = strconv.Atoi(eid)
+	input.Eid = GetEid(c)
+	if input.Cid != 0 && !IsCatalogExists(TenantDB(c, db), input.Cid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "catalog not found"})
+		return
+	}
+	if err := checkItemPlacement(TenantDB(c, db), getCatalogPolicy(db, input.Eid), input.Cid); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	attrs, err := checkItemAttrs(TenantDB(c, db), input.Eid, input.Cid, input.Attrs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.Attrs = attrs
 	item := models.ExItem{
 		ExItemInput: input,
+		Sort:        nextSort(TenantDB(c, db), &models.ExItem{}, "cid", input.Cid),
 	}
 
-	// TODO: NEED PRD check catalog is leaf
-	// if !IsLeafCatalog(db, input.Cid) {
-	// 	c.JSON(http.StatusBadRequest, gin.H{"error": "必须选择叶子类目"})
-	// 	return
-	// }
-
 	if result := db.Create(&item); result.Error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": result.Error})
 		return
@@ -117,7 +178,7 @@ func CreateExItem(c *gin.Context, db *gorm.DB) {
 func GetExItem(c *gin.Context, db *gorm.DB) {
 	id := c.Param("id")
 	var item models.ExItem
-	if result := db.First(&item, id); result.Error != nil {
+	if result := TenantDB(c, db).First(&item, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
 		return
 	}
@@ -136,15 +197,11 @@ func GetExItem(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExItem
 // @Router /api/{eid}/items/{id} [patch]
 func UpdateExItem(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
 	id := c.Param("id")
-	eid := c.Param("eid")
+	eid := GetEid(c)
+	tdb := TenantDB(c, db)
 	var item models.ExItem
-	if result := db.First(&item, id); result.Error != nil {
+	if result := tdb.First(&item, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
 		return
 	}
@@ -154,8 +211,49 @@ func UpdateExItem(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	input := ProcessInput(input_).(map[string]interface{})
+	dropBaseFields(input)
 
 	input["eid"] = eid
+	if cid, ok := input["cid"]; ok {
+		cid, _ := cid.(float64)
+		if cid != 0 && !IsCatalogExists(tdb, int(cid)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "catalog not found"})
+			return
+		}
+		// last in its new catalog
+		if int(cid) != item.Cid {
+			if err := checkItemPlacement(tdb, getCatalogPolicy(db, eid), int(cid)); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			input["sort"] = nextSort(tdb, &models.ExItem{}, "cid", int(cid))
+		}
+	}
+
+	// the attributes follow the schema of the catalog the item ends up in
+	rawAttrs, setAttrs := input_["attrs"]
+	_, setCid := input["cid"]
+	if setAttrs || setCid {
+		raw := item.Attrs
+		if setAttrs {
+			raw, _ = json.Marshal(rawAttrs)
+		}
+		cid := item.Cid
+		if value, ok := input["cid"].(float64); ok {
+			cid = int(value)
+		}
+		attrs, err := checkItemAttrs(tdb, eid, cid, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if setAttrs {
+			input["attrs"] = nil
+			if attrs != nil {
+				input["attrs"] = string(attrs)
+			}
+		}
+	}
 
 	var fieldsToUpdate []string
 	for key := range input {
@@ -174,24 +272,26 @@ func UpdateExItem(c *gin.Context, db *gorm.DB) {
 
 // DeleteExItem godoc
 // @Summary Delete an item by ID
+// @Description An item with rates, amounts or comments is only deleted with policy cascade, deleting
+// @Description them too, which returns what would be affected until confirm=true.
 // @Tags item
 // @Security BearerAuth
+// @Produce json
 // @Param eid path int true "models.Exibition ID"
 // @Param id path int true "ExItem ID"
-// @Success 200
+// @Param policy query string false "refuse (default) or cascade"
+// @Param confirm query bool false "apply the delete"
+// @Success 200 {object} DeletePlan
+// @Failure 409 {object} map[string]interface{}
 // @Router /api/{eid}/items/{id} [delete]
 func DeleteExItem(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
 	id := c.Param("id")
 	var item models.ExItem
-	if result := db.First(&item, id); result.Error != nil {
+	if result := TenantDB(c, db).First(&item, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "item not found"})
 		return
 	}
-	db.Delete(&item)
-	c.JSON(http.StatusOK, gin.H{"message": "item deleted successfully"})
+	policy, _ := deletePolicy(c)
+	plan, err := planItemDelete(TenantDB(c, db), &item, policy)
+	runDelete(c, db, plan, err, plan.apply)
 }
@@ -6,7 +6,6 @@ package services
 import (
 	"go-http-svc/models"
 	"net/http"
-	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -23,13 +22,8 @@ import (
 // @Success 200 {object} models.ExAmount
 // @Router /api/{eid}/amounts [put]
 func CreateExAmount(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatched eid"})
-		return
-	}
+	eid := GetEid(c)
+	claims := GetClaims(c)
 
 	var input models.ExAmountInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -40,8 +34,14 @@ func CreateExAmount(c *gin.Context, db *gorm.DB) {
 	input.Eid = eid
 	input.Uid = claims.UserId
 
+	tdb := TenantDB(c, db)
+	if !IsItemExists(tdb, input.Iid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "item not found"})
+		return
+	}
+
 	var amount models.ExAmount
-	if result := db.Where("uid=? and iid=? and eid=?", claims.UserId, input.Iid, input.Eid).First(&amount); result.Error != nil {
+	if result := tdb.Where("uid=? and iid=?", claims.UserId, input.Iid).First(&amount); result.Error != nil {
 		amount = models.ExAmount{
 			ExAmountInput: input,
 		}
@@ -73,7 +73,7 @@ func CreateExAmount(c *gin.Context, db *gorm.DB) {
 func GetExAmount(c *gin.Context, db *gorm.DB) {
 	id := c.Param("id")
 	var amount models.ExAmount
-	if result := db.First(&amount, id); result.Error != nil {
+	if result := TenantDB(c, db).First(&amount, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "amount not found"})
 		return
 	}
@@ -90,17 +90,11 @@ func GetExAmount(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExAmount
 // @Router /api/{eid}/amount_item/{id} [get]
 func GetMyAmountByItemID(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
+	claims := GetClaims(c)
 
 	id := c.Param("id")
 	var amount models.ExAmount
-	if result := db.Where("iid=? and uid=?", id, claims.UserId).First(&amount); result.Error != nil {
+	if result := TenantDB(c, db).Where("iid=? and uid=?", id, claims.UserId).First(&amount); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "amount not found"})
 		return
 	}
@@ -117,17 +111,9 @@ func GetMyAmountByItemID(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExAmount
 // @Router /api/{eid}/amounts_item/{id} [get]
 func GetTotalAmountsByItemID(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
-
 	id := c.Param("id")
 	var amounts []models.ExAmount
-	if result := db.Where("iid=?", id).Find(&amounts); result.Error != nil {
+	if result := TenantDB(c, db).Where("iid=?", id).Find(&amounts); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "amount not found"})
 		return
 	}
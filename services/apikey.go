@@ -0,0 +1,142 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"go-http-svc/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const apiKeyPrefix = "exk_"
+
+// CreateApiKey godoc
+// @Summary Create an API key
+// @Description The key is only returned this time. Its permissions must be held by the caller,
+// @Description and keys of an exhibition can't manage exhibitions.
+// @Tags apikey
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param eid path int true "Exibition ID, 0 for a global key"
+// @Param key body models.ApiKeyInput true "Name, permissions and validity"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/api_keys [put]
+func CreateApiKey(c *gin.Context, db *gorm.DB) {
+	eid := GetEid(c)
+	var input models.ApiKeyInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, perm := range input.Perms {
+		if !models.IsValidPerm(perm) || (eid != 0 && perm == models.PermExibitionManage) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid permission " + perm})
+			return
+		}
+		if !HasPerm(c, perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "can not grant permission " + perm})
+			return
+		}
+	}
+
+	key := apiKeyPrefix + RandomToken(24)
+	apiKey := models.ExApiKey{
+		Eid:       eid,
+		Name:      input.Name,
+		Prefix:    key[:12],
+		KeyHash:   HashToken(key),
+		Perms:     strings.Join(input.Perms, ","),
+		CreatedBy: GetClaims(c).UserId,
+	}
+	if input.ExpiresIn > 0 {
+		expiresAt := time.Now().AddDate(0, 0, input.ExpiresIn)
+		apiKey.ExpiresAt = &expiresAt
+	}
+	if result := db.Create(&apiKey); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"key": key, "api_key": apiKey})
+}
+
+// GetApiKeys godoc
+// @Summary Get the API keys of an exhibition
+// @Tags apikey
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "Exibition ID, 0 for the global keys"
+// @Success 200 {array} models.ExApiKey
+// @Router /api/{eid}/api_keys [get]
+func GetApiKeys(c *gin.Context, db *gorm.DB) {
+	var keys []models.ExApiKey
+	if result := TenantDB(c, db).Order("id desc").Find(&keys); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// RevokeApiKey godoc
+// @Summary Revoke an API key
+// @Tags apikey
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "Exibition ID"
+// @Param id path int true "models.ExApiKey ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/api_keys/{id} [delete]
+func RevokeApiKey(c *gin.Context, db *gorm.DB) {
+	result := TenantDB(c, db).Model(&models.ExApiKey{}).Where("id=? and is_active=?", c.Param("id"), true).Update("is_active", false)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "api key revoked"})
+}
+
+// ApiKeyFromRequest returns the key of the X-API-Key header or of an
+// "Authorization: ApiKey <key>" header
+func ApiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "ApiKey "); ok {
+		return strings.TrimSpace(key)
+	}
+	return ""
+}
+
+// ValidateApiKey returns the claims granted by an API key, nil when it's
+// unknown, revoked or expired
+func ValidateApiKey(c *gin.Context, db *gorm.DB, key string) *models.Claims {
+	var apiKey models.ExApiKey
+	if err := db.Where("key_hash=?", HashToken(key)).First(&apiKey).Error; err != nil {
+		return nil
+	}
+	now := time.Now()
+	if !apiKey.IsActive || (apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(now)) {
+		return nil
+	}
+
+	// written at most once a minute, keys of kiosks are used on every request
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > time.Minute || apiKey.LastUsedIp != c.ClientIP() {
+		db.Model(&apiKey).Updates(map[string]interface{}{"last_used_at": &now, "last_used_ip": c.ClientIP()})
+	}
+
+	return &models.Claims{
+		Username: "apikey:" + apiKey.Name,
+		Eid:      apiKey.Eid,
+		Perms:    apiKey.Perms,
+		ApiKey:   apiKey.ID,
+	}
+}
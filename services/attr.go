@@ -0,0 +1,336 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-http-svc/models"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// attrKey is the form of an attribute key, which goes as is in the JSON
+// paths of GetExItems
+var attrKey = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+var errAttrs = errors.New("invalid attributes")
+
+const attrDate = "2006-01-02"
+
+// attrSchema is the ExAttrDefs of an exhibition
+type attrSchema []models.ExAttrDef
+
+func loadAttrSchema(db *gorm.DB, eid int) (attrSchema, error) {
+	var schema attrSchema
+	err := db.Where("eid=?", eid).Order("sort, id").Find(&schema).Error
+	return schema, err
+}
+
+func (s attrSchema) find(key string) *models.ExAttrDef {
+	for i := range s {
+		if s[i].Key == key {
+			return &s[i]
+		}
+	}
+	return nil
+}
+
+// check checks the attributes of an item under the top level catalog root,
+// and returns them as JSON, nil for none
+func (s attrSchema) check(root int, attrs map[string]interface{}) (json.RawMessage, error) {
+	for i := range s {
+		def := &s[i]
+		value, ok := attrs[def.Key]
+		if def.Rid != 0 && def.Rid != root {
+			if ok {
+				return nil, fmt.Errorf("%w: %s isn't an attribute of the catalog", errAttrs, def.Key)
+			}
+			continue
+		}
+		if !ok || value == nil || value == "" {
+			if def.Required {
+				return nil, fmt.Errorf("%w: %s is required", errAttrs, def.Key)
+			}
+			delete(attrs, def.Key)
+			continue
+		}
+		if err := checkAttr(def, value); err != nil {
+			return nil, err
+		}
+	}
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(attrs)
+}
+
+func attrOptions(def *models.ExAttrDef) []string {
+	var options []string
+	json.Unmarshal(def.Options, &options)
+	return options
+}
+
+// checkAttr checks a value decoded from JSON
+func checkAttr(def *models.ExAttrDef, value interface{}) error {
+	ok := false
+	switch def.Type {
+	case models.AttrString:
+		_, ok = value.(string)
+	case models.AttrNumber:
+		_, ok = value.(float64)
+	case models.AttrBool:
+		_, ok = value.(bool)
+	case models.AttrEnum:
+		s, isString := value.(string)
+		ok = isString && containsName(attrOptions(def), s)
+	case models.AttrDate:
+		s, isString := value.(string)
+		_, err := time.Parse(attrDate, s)
+		ok = isString && err == nil
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s is not a valid %s", errAttrs, def.Key, def.Type)
+	}
+	return nil
+}
+
+// parseAttr reads a value from text, eg. a spreadsheet cell
+func parseAttr(def *models.ExAttrDef, text string) (interface{}, error) {
+	var value interface{} = text
+	var err error
+	switch def.Type {
+	case models.AttrNumber:
+		value, err = strconv.ParseFloat(text, 64)
+	case models.AttrBool:
+		value, err = strconv.ParseBool(text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s is not a valid %s", errAttrs, def.Key, def.Type)
+	}
+	return value, checkAttr(def, value)
+}
+
+// decodeAttrs decodes the attributes of an item, null for none
+func decodeAttrs(raw json.RawMessage) (map[string]interface{}, error) {
+	attrs := map[string]interface{}{}
+	if len(raw) == 0 {
+		return attrs, nil
+	}
+	if err := json.Unmarshal(raw, &attrs); err != nil {
+		return nil, fmt.Errorf("%w: not an object", errAttrs)
+	}
+	if attrs == nil {
+		attrs = map[string]interface{}{}
+	}
+	return attrs, nil
+}
+
+// catalogRoot returns the id of the top level catalog above catalog cid,
+// the catalog itself at the top level, 0 for none
+func catalogRoot(db *gorm.DB, cid int) int {
+	if cid == 0 {
+		return 0
+	}
+	var catalog models.ExCatalog
+	if err := db.Select("id, pid, root_id").First(&catalog, cid).Error; err != nil {
+		return 0
+	}
+	if catalog.Pid == 0 {
+		return catalog.ID
+	}
+	return catalog.RootId
+}
+
+// checkItemAttrs checks the attributes of an item of catalog cid against
+// the schema of exhibition eid, see attrSchema.check
+func checkItemAttrs(db *gorm.DB, eid int, cid int, raw json.RawMessage) (json.RawMessage, error) {
+	attrs, err := decodeAttrs(raw)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := loadAttrSchema(db, eid)
+	if err != nil {
+		return nil, err
+	}
+	return schema.check(catalogRoot(db, cid), attrs)
+}
+
+// attrColumn is the SQL of the value of an attribute of ex_items, its key
+// was checked against attrKey
+func attrColumn(def *models.ExAttrDef) string {
+	path := "JSON_EXTRACT(ex_items.attrs, '$." + def.Key + "')"
+	if def.Type == models.AttrNumber {
+		return "CAST(" + path + " AS DECIMAL(20,6))"
+	}
+	return "JSON_UNQUOTE(" + path + ")"
+}
+
+// attrValue reads a value of a query parameter, as compared to attrColumn
+func attrValue(def *models.ExAttrDef, text string) (interface{}, error) {
+	value, err := parseAttr(def, text)
+	if err == nil && def.Type == models.AttrBool {
+		value = strconv.FormatBool(value.(bool))
+	}
+	return value, err
+}
+
+// checkAttrDef checks a definition of the exhibition, id is its own id, 0
+// when it's new
+func checkAttrDef(db *gorm.DB, def *models.ExAttrDefInput, id int) error {
+	if !attrKey.MatchString(def.Key) {
+		return errors.New("key is lowercase letters, digits and _, starting with a letter")
+	}
+	switch def.Type {
+	case models.AttrString, models.AttrNumber, models.AttrBool, models.AttrDate:
+	case models.AttrEnum:
+		var options []string
+		if err := json.Unmarshal(def.Options, &options); err != nil || len(options) == 0 {
+			return errors.New("options of an enum is a list of strings")
+		}
+	default:
+		return errors.New("type is string, number, enum, bool or date")
+	}
+	var count int64
+	if def.Rid != 0 {
+		db.Model(&models.ExCatalog{}).Where("id=? and pid=0", def.Rid).Count(&count)
+		if count == 0 {
+			return errors.New("rid is not a top level catalog")
+		}
+	}
+	db.Model(&models.ExAttrDef{}).Where("`key`=? and id<>?", def.Key, id).Count(&count)
+	if count > 0 {
+		return errors.New("key " + def.Key + " already exists")
+	}
+	return nil
+}
+
+// GetExAttrDefs godoc
+// @Summary Get the item attributes of an exibition
+// @Tags attr
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Success 200 {array} models.ExAttrDef
+// @Router /api/{eid}/attrs [get]
+func GetExAttrDefs(c *gin.Context, db *gorm.DB) {
+	var defs []models.ExAttrDef
+	if result := TenantDB(c, db).Order("sort, id").Find(&defs); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, defs)
+}
+
+// CreateExAttrDef godoc
+// @Summary Define an item attribute
+// @Description type is string, number, enum (one of options), bool or date (YYYY-MM-DD). rid limits
+// @Description the attribute to the items under a top level catalog, 0 for all the items. Items
+// @Description already there aren't checked against a new required attribute.
+// @Tags attr
+// @Security BearerAuth
+// @Accept  json
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param attr body models.ExAttrDefInput true "models.ExAttrDef Input"
+// @Success 200 {object} models.ExAttrDef
+// @Router /api/{eid}/attrs [put]
+func CreateExAttrDef(c *gin.Context, db *gorm.DB) {
+	var input models.ExAttrDefInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input.Eid = GetEid(c)
+	if err := checkAttrDef(TenantDB(c, db), &input, 0); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	def := models.ExAttrDef{ExAttrDefInput: input}
+	if result := db.Create(&def); result.Error != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, def)
+}
+
+// UpdateExAttrDef godoc
+// @Summary Update an item attribute by ID
+// @Description The key can't change. Items already there aren't checked again.
+// @Tags attr
+// @Security BearerAuth
+// @Accept  json
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param id path int true "models.ExAttrDef ID"
+// @Param attr body models.ExAttrDefInput true "models.ExAttrDef Input"
+// @Success 200 {object} models.ExAttrDef
+// @Router /api/{eid}/attrs/{id} [patch]
+func UpdateExAttrDef(c *gin.Context, db *gorm.DB) {
+	var def models.ExAttrDef
+	if result := TenantDB(c, db).First(&def, c.Param("id")); result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "attribute not found"})
+		return
+	}
+	var input_ map[string]interface{}
+	if err := c.ShouldBindJSON(&input_); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	delete(input_, "key")
+	delete(input_, "eid")
+	dropBaseFields(input_)
+
+	// the definition as it would be
+	merged := def.ExAttrDefInput
+	data, _ := json.Marshal(input_)
+	if err := json.Unmarshal(data, &merged); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkAttrDef(TenantDB(c, db), &merged, def.ID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input := ProcessInput(input_).(map[string]interface{})
+	var fieldsToUpdate []string
+	for key := range input {
+		fieldsToUpdate = append(fieldsToUpdate, key)
+	}
+	if err := db.Model(&def).Select(fieldsToUpdate).Updates(input).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, def)
+}
+
+// DeleteExAttrDef godoc
+// @Summary Delete an item attribute by ID
+// @Description The values stay in the attrs of the items, unchecked.
+// @Tags attr
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param id path int true "models.ExAttrDef ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/attrs/{id} [delete]
+func DeleteExAttrDef(c *gin.Context, db *gorm.DB) {
+	var def models.ExAttrDef
+	if result := TenantDB(c, db).First(&def, c.Param("id")); result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "attribute not found"})
+		return
+	}
+	if result := db.Delete(&def); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "attribute deleted"})
+}
@@ -0,0 +1,406 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-http-svc/models"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// An exhibition bundle is a zip of one JSON file per table plus the files
+// of uploads/ referenced by the exhibition, its catalogs and its items:
+//
+//	manifest.json  exibition.json  catalogs.json  items.json
+//	users.json  rates.json  amounts.json  comments.json  attrs.json
+//	uploads/...
+//
+// Ids are those of the exporting server, they are remapped on import.
+// Bundles written before attrs.json existed are imported without it.
+const bundleFormat = 1
+
+var ErrInvalidBundle = errors.New("invalid bundle")
+
+// the largest file accepted from a bundle
+const maxBundleEntry = 256 << 20
+
+// uploaded files are named by UploadFile, uuid and extension
+var uploadRef = regexp.MustCompile(`uploads/([0-9A-Za-z_-][0-9A-Za-z._-]*)`)
+
+type bundleManifest struct {
+	Format     int       `json:"format"`
+	Eid        int       `json:"eid"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// bundleUser keeps the password hash that ExUser.MarshalJSON leaves out,
+// so that the users can still log in after an import
+type bundleUser models.ExUser
+
+type ExibitionBundle struct {
+	Exibition models.Exibition
+	Catalogs  []models.ExCatalog
+	Items     []models.ExItem
+	Users     []bundleUser
+	Rates     []models.ExRate
+	Amounts   []models.ExAmount
+	Comments  []models.ExComment
+	AttrDefs  []models.ExAttrDef
+}
+
+type bundleResult struct {
+	Exibition models.Exibition `json:"exibition"`
+	Catalogs  IdMap            `json:"catalogs"`
+	Items     IdMap            `json:"items"`
+	Users     IdMap            `json:"users"`
+	// users whose uname was taken on this server, old uname to new uname
+	Renamed map[string]string `json:"renamed,omitempty"`
+	// rates, amounts and comments of users outside the exhibition
+	Skipped int `json:"skipped"`
+	Files   int `json:"files"`
+}
+
+// LoadExibitionBundle reads exhibition eid and everything belonging to it,
+// deleted rows are left out
+func LoadExibitionBundle(db *gorm.DB, eid int) (*ExibitionBundle, error) {
+	b := &ExibitionBundle{}
+	if err := db.First(&b.Exibition, eid).Error; err != nil {
+		return nil, err
+	}
+	for _, dest := range []interface{}{&b.Catalogs, &b.Items, &b.Users, &b.Rates, &b.Amounts, &b.Comments, &b.AttrDefs} {
+		if err := db.Where("eid=?", eid).Order("id").Find(dest).Error; err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Write writes the bundle as a zip to w, with the files of uploadsDir it
+// references
+func (b *ExibitionBundle) Write(w io.Writer, uploadsDir string) error {
+	zw := zip.NewWriter(w)
+	files := map[string]bool{}
+	entries := []struct {
+		name  string
+		value interface{}
+	}{
+		{"manifest.json", bundleManifest{Format: bundleFormat, Eid: b.Exibition.ID, ExportedAt: time.Now()}},
+		{"exibition.json", b.Exibition},
+		{"catalogs.json", b.Catalogs},
+		{"items.json", b.Items},
+		{"users.json", b.Users},
+		{"rates.json", b.Rates},
+		{"amounts.json", b.Amounts},
+		{"comments.json", b.Comments},
+		{"attrs.json", b.AttrDefs},
+	}
+	for _, entry := range entries {
+		data, err := json.MarshalIndent(entry.value, "", "  ")
+		if err != nil {
+			return err
+		}
+		for _, match := range uploadRef.FindAllSubmatch(data, -1) {
+			files[string(match[1])] = true
+		}
+		f, err := zw.Create(entry.name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+
+	for name := range files {
+		src, err := os.Open(filepath.Join(uploadsDir, name))
+		if err != nil {
+			// a dangling reference, nothing to copy
+			continue
+		}
+		f, err := zw.Create("uploads/" + name)
+		if err == nil {
+			_, err = io.Copy(f, src)
+		}
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// ImportExibitionBundle restores a bundle as a new draft exhibition,
+// remapping the ids of catalogs, items and users. Files of the bundle are
+// written to uploadsDir unless a file with the same name exists.
+func ImportExibitionBundle(db *gorm.DB, zr *zip.Reader, uploadsDir string) (*bundleResult, error) {
+	var manifest bundleManifest
+	if err := readBundleFile(zr, "manifest.json", &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Format != bundleFormat {
+		return nil, fmt.Errorf("%w: unsupported format %d", ErrInvalidBundle, manifest.Format)
+	}
+	b := &ExibitionBundle{}
+	for name, dest := range map[string]interface{}{
+		"exibition.json": &b.Exibition, "catalogs.json": &b.Catalogs, "items.json": &b.Items,
+		"users.json": &b.Users, "rates.json": &b.Rates, "amounts.json": &b.Amounts, "comments.json": &b.Comments,
+	} {
+		if err := readBundleFile(zr, name, dest); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := fs.Stat(zr, "attrs.json"); err == nil {
+		if err := readBundleFile(zr, "attrs.json", &b.AttrDefs); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := &bundleResult{Catalogs: IdMap{}, Items: IdMap{}, Users: IdMap{}, Renamed: map[string]string{}}
+	// files first, a failed import leaves at most unreferenced files behind
+	for _, f := range zr.File {
+		name, ok := strings.CutPrefix(f.Name, "uploads/")
+		// only plain file names, never a path out of uploadsDir
+		if !ok || uploadRef.FindString("uploads/"+name) != "uploads/"+name {
+			continue
+		}
+		written, err := extractBundleFile(f, filepath.Join(uploadsDir, name))
+		if err != nil {
+			return nil, err
+		}
+		if written {
+			ret.Files++
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return b.restore(tx, ret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (b *ExibitionBundle) restore(tx *gorm.DB, ret *bundleResult) error {
+	exibition := models.Exibition{ExibitionInput: b.Exibition.ExibitionInput, CatalogPolicy: b.Exibition.CatalogPolicy, Status: models.ExibitionDraft}
+	if err := createInactive(tx, &exibition, false); err != nil {
+		return err
+	}
+	ret.Exibition = exibition
+	eid := exibition.ID
+
+	if err := copyCatalogs(tx, b.Catalogs, eid, ret.Catalogs); err != nil {
+		return err
+	}
+
+	for _, def := range b.AttrDefs {
+		def.ID = 0
+		def.Eid = eid
+		def.Rid = ret.Catalogs[def.Rid]
+		if err := createInactive(tx, &def, def.IsActive); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range b.Items {
+		oldId := item.ID
+		item.ID = 0
+		item.Eid = eid
+		item.Cid = ret.Catalogs[item.Cid]
+		if err := createInactive(tx, &item, item.IsActive); err != nil {
+			return err
+		}
+		ret.Items[oldId] = item.ID
+	}
+
+	for _, old := range b.Users {
+		user := models.ExUser(old)
+		user.ID = 0
+		user.Eid = eid
+		user.Role = models.RoleOfEid(user.EffectiveRole(), eid)
+		// the second factor and the linked identity stay on the old server
+		user.TotpEnabled = false
+		var count int64
+		// unames are unique among the users not deleted
+		if err := tx.Model(&models.ExUser{}).Where("uname=?", user.Uname).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			user.Uname = old.Uname + "_" + generateRandomUsername(4)
+			ret.Renamed[old.Uname] = user.Uname
+		}
+		if err := createInactive(tx, &user, old.IsActive); err != nil {
+			return err
+		}
+		ret.Users[old.ID] = user.ID
+	}
+
+	// rates, amounts and comments only make sense for imported items and users
+	remap := func(base *models.Base, uid, iid *int) bool {
+		newUid, okUser := ret.Users[*uid]
+		newIid, okItem := ret.Items[*iid]
+		if !okUser || !okItem {
+			ret.Skipped++
+			return false
+		}
+		base.ID = 0
+		*uid, *iid = newUid, newIid
+		return true
+	}
+	for _, rate := range b.Rates {
+		if remap(&rate.Base, &rate.Uid, &rate.Iid) {
+			rate.Eid = eid
+			if err := createInactive(tx, &rate, rate.IsActive); err != nil {
+				return err
+			}
+		}
+	}
+	for _, amount := range b.Amounts {
+		if remap(&amount.Base, &amount.Uid, &amount.Iid) {
+			amount.Eid = eid
+			if err := createInactive(tx, &amount, amount.IsActive); err != nil {
+				return err
+			}
+		}
+	}
+	for _, comment := range b.Comments {
+		if remap(&comment.Base, &comment.Uid, &comment.Iid) {
+			comment.Eid = eid
+			if err := createInactive(tx, &comment, comment.IsActive); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readBundleFile(zr *zip.Reader, name string, dest interface{}) error {
+	f, err := zr.Open(name)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBundle, err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(io.LimitReader(f, maxBundleEntry)).Decode(dest); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidBundle, name, err)
+	}
+	return nil
+}
+
+// extractBundleFile writes f to path, returns false when path exists
+func extractBundleFile(f *zip.File, path string) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), fs.ModePerm); err != nil {
+		return false, err
+	}
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	src, err := f.Open()
+	if err == nil {
+		var n int64
+		n, err = io.Copy(dst, io.LimitReader(src, maxBundleEntry+1))
+		src.Close()
+		if err == nil && n > maxBundleEntry {
+			err = fmt.Errorf("%w: %s is too large", ErrInvalidBundle, f.Name)
+		}
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return false, err
+	}
+	return true, nil
+}
+
+// ExportExibition godoc
+// @Summary Export an exibition as a bundle
+// @Description A zip with the exibition, its catalogs, items, users, rates, amounts, comments and item attributes
+// @Description as JSON, and the uploaded files they reference. See ImportExibition.
+// @Tags exibition
+// @Security BearerAuth
+// @Produce application/zip
+// @Param id path int true "Exibition ID"
+// @Success 200 {file} file
+// @Router /api/exibitions/{id}/export [get]
+func ExportExibition(c *gin.Context, db *gorm.DB) {
+	eid, _ := strconv.Atoi(c.Param("id"))
+	bundle, err := LoadExibitionBundle(db, eid)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "exibition not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="exibition-%d.zip"`, eid))
+	if err := bundle.Write(c.Writer, "uploads"); err != nil {
+		// the response has started, all we can do is cut it short
+		c.Error(err)
+		c.Abort()
+	}
+}
+
+// ImportExibition godoc
+// @Summary Import an exibition bundle
+// @Description Restores a bundle made by ExportExibition as a new draft exibition, with new ids.
+// @Description Users keep their password, users whose uname is taken are renamed. Returns the
+// @Description old id to new id mappings.
+// @Tags exibition
+// @Security BearerAuth
+// @Accept mpfd
+// @Produce json
+// @Param file formData file true "exibition bundle"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/exibitions/import [put]
+func ImportExibition(c *gin.Context, db *gorm.DB) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
+		return
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, file.Size)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidBundle.Error() + ": " + err.Error()})
+		return
+	}
+
+	ret, err := ImportExibitionBundle(db, zr, "uploads")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidBundle) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ret)
+}
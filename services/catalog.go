@@ -5,13 +5,14 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go-http-svc/models"
 	"net/http"
-	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // GetExCatalog godoc
@@ -24,14 +25,8 @@ import (
 // @Success 200 {array} models.ExCatalog
 // @Router /api/{eid}/catalogs [get]
 func GetExCatalogs(c *gin.Context, db *gorm.DB) {
-	eid, err := strconv.Atoi(c.Param("eid"))
-	fmt.Println(eid, err)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
 	var catalogs []models.ExCatalog
-	if result := db.Where("eid=?", eid).Order("create_time desc").Find(&catalogs); result.Error != nil {
+	if result := TenantDB(c, db).Order("pid, sort, create_time desc").Find(&catalogs); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
 		return
 	}
@@ -44,18 +39,25 @@ func getRootCatalog(db *gorm.DB, pid int, eid int) models.ExCatalog {
 		WITH RECURSIVE parent_tree AS (
 			SELECT *
 			FROM ex_catalogs
-			WHERE id = ? and eid = ?
+			WHERE id = ? and eid = ? and is_deleted = false
 			UNION ALL
 			SELECT t.*
 			FROM ex_catalogs t
 			INNER JOIN parent_tree pt ON t.id = pt.pid
+			WHERE t.is_deleted = false
 		)
-		SELECT * FROM parent_tree ORDER BY id limit 1;
+		SELECT * FROM parent_tree WHERE pid = 0 limit 1;
 	`
 	db.Raw(query, pid, eid).Scan(&catalog)
 	return catalog
 }
 
+func IsCatalogExists(db *gorm.DB, cid int) bool {
+	var count int64
+	db.Model(&models.ExCatalog{}).Where("id=?", cid).Count(&count)
+	return count > 0
+}
+
 func IsLeafCatalog(db *gorm.DB, cid int) bool {
 	var count int64
 	db.Model(&models.ExCatalog{}).Where("pid=?", cid).Count(&count)
@@ -79,16 +81,7 @@ func IsCatalogHasItem(db *gorm.DB, cid int) bool {
 // @Success 200 {object} models.ExCatalog
 // @Router /api/{eid}/catalogs [put]
 func CreateExCatalog(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
+	eid := GetEid(c)
 	var input models.ExCatalogInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -99,20 +92,21 @@ func CreateExCatalog(c *gin.Context, db *gorm.DB) {
 	rid := 0
 
 	if input.Pid != 0 {
-		root := getRootCatalog(db, input.Pid, input.Eid)
-		if root.Pid != 0 {
-			rid = root.ID
-		}
-		// TODO: NEED PRD check if the parent catalog has any item
-		if IsCatalogHasItem(db, input.Pid) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "类目下有单品, 不能创建子类目. 需删除其关联的所有单品"})
+		if !IsCatalogExists(TenantDB(c, db), input.Pid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "parent catalog not found"})
 			return
 		}
+		rid = getRootCatalog(db, input.Pid, input.Eid).ID
+	}
+	if err := checkCatalogPlacement(TenantDB(c, db), getCatalogPolicy(db, eid), eid, input.Pid, 1); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	catalog := models.ExCatalog{
 		ExCatalogInput: input,
 		RootId:         rid,
+		Sort:           nextSort(TenantDB(c, db), &models.ExCatalog{}, "pid", input.Pid),
 	}
 
 	if result := db.Create(&catalog); result.Error != nil {
@@ -132,15 +126,9 @@ func CreateExCatalog(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExCatalog
 // @Router /api/{eid}/catalogs/{id} [get]
 func GetExCatalog(c *gin.Context, db *gorm.DB) {
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
-
 	id := c.Param("id")
 	var catalog models.ExCatalog
-	if result := db.Where("eid=?", eid).First(&catalog, id); result.Error != nil {
+	if result := TenantDB(c, db).First(&catalog, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "catalog not found"})
 		return
 	}
@@ -159,19 +147,10 @@ func GetExCatalog(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExCatalog
 // @Router /api/{eid}/catalogs/{id} [patch]
 func UpdateExCatalog(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
+	eid := GetEid(c)
 	id := c.Param("id")
 	var catalog models.ExCatalog
-	if result := db.Where("eid=?", eid).First(&catalog, id); result.Error != nil {
+	if result := TenantDB(c, db).First(&catalog, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "catalog not found"})
 		return
 	}
@@ -181,8 +160,13 @@ func UpdateExCatalog(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	input := ProcessInput(input_).(map[string]interface{})
+	dropBaseFields(input)
 
 	input["eid"] = eid
+	// the root follows the parent, which only changes through moveCatalog
+	delete(input, "root_id")
+	pid, move := input["pid"]
+	delete(input, "pid")
 
 	var fieldsToUpdate []string
 	for key := range input {
@@ -190,7 +174,23 @@ func UpdateExCatalog(c *gin.Context, db *gorm.DB) {
 	}
 
 	// Use GORM’s Updates method to perform a partial update
-	if err := db.Model(&catalog).Select(fieldsToUpdate).Updates(input).Error; err != nil {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if move {
+			pid, ok := pid.(float64)
+			if !ok {
+				return errInvalidMove
+			}
+			if err := moveCatalog(tx, &catalog, int(pid)); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&catalog).Select(fieldsToUpdate).Updates(input).Error
+	})
+	if errors.Is(err, errInvalidMove) || errors.Is(err, errPlacement) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		fmt.Println("error: ", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -200,33 +200,166 @@ func UpdateExCatalog(c *gin.Context, db *gorm.DB) {
 	c.JSON(http.StatusOK, catalog)
 }
 
-// DeleteExCatalog godoc
-// @Summary Delete an catalog by ID
+var errInvalidMove = errors.New("invalid parent catalog")
+
+// moveCatalog moves catalog under the catalog pid, 0 for the top level, and
+// updates the RootId of its subtree. The new parent can't be in the subtree
+// and must follow the catalog policy of the exhibition, see checkCatalogPlacement.
+func moveCatalog(tx *gorm.DB, catalog *models.ExCatalog, pid int) error {
+	// the catalog, then the new parent and its ancestors are locked, so a
+	// concurrent move of any of them waits and the walk up sees committed
+	// pids: two moves can't put catalogs under each other
+	locking := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Session(&gorm.Session{})
+	if err := locking.Select("id, pid").First(&models.ExCatalog{}, catalog.ID).Error; err != nil {
+		return err
+	}
+	seen := map[int]bool{}
+	for id := pid; id != 0 && !seen[id]; {
+		if id == catalog.ID {
+			return fmt.Errorf("%w: it's the catalog or under it", errInvalidMove)
+		}
+		seen[id] = true
+		var parent models.ExCatalog
+		if err := locking.Select("id, pid").Where("eid=?", catalog.Eid).First(&parent, id).Error; err != nil {
+			if id == pid {
+				return fmt.Errorf("%w: not found", errInvalidMove)
+			}
+			break
+		}
+		id = parent.Pid
+	}
+
+	subtree, err := catalogSubtree(tx, catalog.Eid, catalog.ID)
+	if err != nil {
+		return err
+	}
+	rid := 0
+	if pid != 0 {
+		rid = getRootCatalog(tx, pid, catalog.Eid).ID
+	}
+	if pid != catalog.Pid {
+		height, err := subtreeHeight(tx, catalog.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkCatalogPlacement(tx.Where("eid=?", catalog.Eid), getCatalogPolicy(tx, catalog.Eid), catalog.Eid, pid, height); err != nil {
+			return err
+		}
+	}
+
+	// last among its new siblings
+	update := map[string]interface{}{"pid": pid, "root_id": rid}
+	if pid != catalog.Pid {
+		update["sort"] = nextSort(tx.Where("eid=?", catalog.Eid), &models.ExCatalog{}, "pid", pid)
+	}
+	if err := tx.Model(catalog).Updates(update).Error; err != nil {
+		return err
+	}
+	if len(subtree) == 0 {
+		return nil
+	}
+	// a catalog at the top level is the root of its subtree
+	if rid == 0 {
+		rid = catalog.ID
+	}
+	return tx.Model(&models.ExCatalog{}).Where("id in ?", subtree).Update("root_id", rid).Error
+}
+
+// FixCatalogRoots recomputes the RootId of all catalogs, deleted ones too,
+// and returns how many were wrong.
+func FixCatalogRoots(db *gorm.DB) (int, error) {
+	var catalogs []models.ExCatalog
+	if err := db.Unscoped().Select("id, pid, root_id").Find(&catalogs).Error; err != nil {
+		return 0, err
+	}
+	pids := make(map[int]int, len(catalogs))
+	for _, catalog := range catalogs {
+		pids[catalog.ID] = catalog.Pid
+	}
+	fixed := 0
+	for _, catalog := range catalogs {
+		rid := 0
+		// walks up to the top level, a cycle or a missing parent stops it
+		for id, n := catalog.Pid, 0; id != 0 && n < len(catalogs); id, n = pids[id], n+1 {
+			rid = id
+		}
+		if rid == catalog.RootId {
+			continue
+		}
+		if err := db.Unscoped().Model(&catalog).UpdateColumn("root_id", rid).Error; err != nil {
+			return fixed, err
+		}
+		fixed++
+	}
+	return fixed, nil
+}
+
+// MoveExCatalog godoc
+// @Summary Move a catalog and its subtree under another catalog
+// @Description pid 0 moves it to the top level. Refused when the new parent is the catalog itself,
+// @Description under it, or when the catalog policy of the exibition doesn't allow it.
 // @Tags catalog
 // @Security BearerAuth
+// @Accept  json
+// @Produce json
 // @Param eid path int true "models.Exibition ID"
-// @Param id path int true "ExCatalog ID"
-// @Success 200
-// @Router /api/{eid}/catalogs/{id} [delete]
-func DeleteExCatalog(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
+// @Param id path int true "models.ExCatalog ID"
+// @Param move body map[string]int true "pid, the new parent"
+// @Success 200 {object} models.ExCatalog
+// @Router /api/{eid}/catalogs/{id}/move [post]
+func MoveExCatalog(c *gin.Context, db *gorm.DB) {
+	var input struct {
+		Pid *int `json:"pid" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var catalog models.ExCatalog
+	if result := TenantDB(c, db).First(&catalog, c.Param("id")); result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "catalog not found"})
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return moveCatalog(tx, &catalog, *input.Pid)
+	})
+	if errors.Is(err, errInvalidMove) || errors.Is(err, errPlacement) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	eid, err := strconv.Atoi(c.Param("eid"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	c.JSON(http.StatusOK, catalog)
+}
+
+// DeleteExCatalog godoc
+// @Summary Delete an catalog by ID
+// @Description A catalog with child catalogs or items is only deleted with policy cascade, deleting
+// @Description them too, or reparent, moving them to the target catalog. These return what would be
+// @Description affected until confirm=true.
+// @Tags catalog
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param id path int true "ExCatalog ID"
+// @Param policy query string false "refuse (default), cascade or reparent"
+// @Param target query int false "reparent: the catalog to move to, 0 for the top level"
+// @Param confirm query bool false "apply the delete"
+// @Success 200 {object} DeletePlan
+// @Failure 409 {object} map[string]interface{}
+// @Router /api/{eid}/catalogs/{id} [delete]
+func DeleteExCatalog(c *gin.Context, db *gorm.DB) {
 	id := c.Param("id")
 	var catalog models.ExCatalog
-	if result := db.Where("eid=?", eid).First(&catalog, id); result.Error != nil {
+	if result := TenantDB(c, db).First(&catalog, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "catalog not found"})
 		return
 	}
-	db.Delete(&catalog)
-	c.JSON(http.StatusOK, gin.H{"message": "catalog deleted successfully"})
+	policy, target := deletePolicy(c)
+	plan, err := planCatalogDelete(TenantDB(c, db), &catalog, policy, target)
+	runDelete(c, db, plan, err, plan.apply)
 }
 
 // GetExCatalogsRoot godoc
@@ -240,15 +373,9 @@ func DeleteExCatalog(c *gin.Context, db *gorm.DB) {
 // @Success 200 {obj} models.ExCatalog
 // @Router /api/{eid}/catalogs_root/{id} [get]
 func GetExCatalogsRoot(c *gin.Context, db *gorm.DB) {
-	eid, err := strconv.Atoi(c.Param("eid"))
-	fmt.Println(eid, err)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
 	id := c.Param("id")
 	var catalog models.ExCatalog
-	if result := db.Where("eid=? AND id=?", eid, id).Order("id desc").First(&catalog); result.Error != nil {
+	if result := TenantDB(c, db).Where("id=?", id).Order("id desc").First(&catalog); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
 		return
 	}
@@ -262,7 +389,7 @@ func GetExCatalogsRoot(c *gin.Context, db *gorm.DB) {
 	fmt.Println("catalog", string(r1))
 	pid := catalog.Pid
 	catalog.ID = 0
-	if result := db.Where("id=?", pid).Order("id desc").First(&catalog); result.Error != nil {
+	if result := TenantDB(c, db).Where("id=?", pid).Order("id desc").First(&catalog); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
 		return
 	}
@@ -278,11 +405,12 @@ func GetParentsUsingCTE(db *gorm.DB, id string, eid int) ([]models.ExCatalog, er
 		WITH RECURSIVE parent_tree AS (
 			SELECT *
 			FROM ex_catalogs
-			WHERE id = ? and eid = ?
+			WHERE id = ? and eid = ? and is_deleted = false
 			UNION ALL
 			SELECT t.*
 			FROM ex_catalogs t
 			INNER JOIN parent_tree pt ON t.id = pt.pid
+			WHERE t.is_deleted = false
 		)
 		SELECT * FROM parent_tree ORDER BY id;
 	`
@@ -306,11 +434,7 @@ func GetParentsUsingCTE(db *gorm.DB, id string, eid int) ([]models.ExCatalog, er
 // @Success 200 {array} models.ExCatalog
 // @Router /api/{eid}/catalogs_path/{id} [get]
 func GetExCatalogsPath(c *gin.Context, db *gorm.DB) {
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
-		return
-	}
+	eid := GetEid(c)
 	// Get the "id" from the URL parameters
 	id := c.Param("id")
 
@@ -326,26 +450,26 @@ func GetExCatalogsPath(c *gin.Context, db *gorm.DB) {
 }
 
 // Query the node and its children up to a certain depth using a recursive CTE
-func GetNodeAndChildren(db *gorm.DB, eid, id, depth string) ([]models.ExCatalog, error) {
+func GetNodeAndChildren(db *gorm.DB, eid int, id, depth string) ([]models.ExCatalog, error) {
 	var nodes []models.ExCatalog
 
 	query := `
 		WITH RECURSIVE children_tree AS (
-			SELECT id, pid, eid, name, description,images, videos, 0 AS depth
+			SELECT id, pid, eid, name, description,images, videos, sort, 0 AS depth
 			FROM ex_catalogs
-			WHERE id = ? and eid = ?
+			WHERE id = ? and eid = ? and is_deleted = false
 			UNION ALL
 			-- Recursive step
-			SELECT t.id, t.pid, t.eid, t.name, t.description,t.images, t.videos, ct.depth + 1
+			SELECT t.id, t.pid, t.eid, t.name, t.description,t.images, t.videos, t.sort, ct.depth + 1
 			FROM ex_catalogs t
 			INNER JOIN children_tree ct ON t.pid = ct.id
-			WHERE ct.depth < ?
+			WHERE ct.depth < ? and t.eid = ? and t.is_deleted = false
 		)
-		SELECT * FROM children_tree ORDER BY id;
+		SELECT * FROM children_tree ORDER BY depth, sort, id;
 	`
 
 	// Execute the query with the given id and depth
-	if err := db.Raw(query, id, eid, depth).Scan(&nodes).Error; err != nil {
+	if err := db.Raw(query, id, eid, depth, eid).Scan(&nodes).Error; err != nil {
 		return nil, err
 	}
 
@@ -364,7 +488,7 @@ func GetNodeAndChildren(db *gorm.DB, eid, id, depth string) ([]models.ExCatalog,
 // @Success 200 {array} models.ExCatalog
 // @Router /api/api/{eid}/sub_catalogs/{id} [get]
 func GetExCatalogsChildren(c *gin.Context, db *gorm.DB) {
-	eid := c.Param("eid")
+	eid := GetEid(c)
 	// Get the "id" from the URL parameters
 	id := c.Param("id")
 	depth := c.Query("depth")
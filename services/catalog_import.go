@@ -0,0 +1,372 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"go-http-svc/models"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// A catalog spreadsheet has a header row, then a catalog per row, either
+//
+//	level 1 | level 2 | level 3 | name_en | title | description
+//
+// with the names along the path of the catalog, blank levels before the
+// last one repeating the row above, or
+//
+//	path | name | name_en | title | description
+//
+// with the names of the parents separated by "/". Missing parents are
+// created along with the row, catalogs already there are left as they are.
+
+var levelColumn = regexp.MustCompile(`^level_?(\d+)$`)
+
+// CatalogImportRow is the outcome of a row of a catalog import
+type CatalogImportRow struct {
+	// row number in the spreadsheet, from 1
+	Row    int    `json:"row"`
+	Path   string `json:"path"`
+	ID     int    `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// the parents missing from the spreadsheet, created with the row
+	Parents []string `json:"parents,omitempty"`
+}
+
+// CatalogImport is the report of a catalog import
+type CatalogImport struct {
+	DryRun  bool                `json:"dry_run"`
+	Created int                 `json:"created"`
+	Errors  int                 `json:"errors"`
+	Rows    []*CatalogImportRow `json:"rows"`
+}
+
+type importNode struct {
+	catalog  models.ExCatalog
+	parent   *importNode
+	children map[string]*importNode
+	// existing catalog with items, can't get children when items only go in leaves
+	items bool
+	// created by the import, by row or as a missing parent when row is nil
+	fresh    bool
+	row      *CatalogImportRow
+	nextSort int
+}
+
+func (n *importNode) child(name string) *importNode {
+	child := &importNode{
+		catalog:  models.ExCatalog{ExCatalogInput: models.ExCatalogInput{Eid: n.catalog.Eid, Name: name}},
+		parent:   n,
+		children: map[string]*importNode{},
+		fresh:    true,
+		nextSort: 1,
+	}
+	child.catalog.Sort = n.nextSort
+	n.nextSort++
+	n.children[name] = child
+	return child
+}
+
+// catalogImporter places the rows of a spreadsheet in the catalog tree of
+// an exhibition
+type catalogImporter struct {
+	root   *importNode
+	byId   map[int]*importNode
+	fresh  []*importNode
+	policy models.CatalogPolicy
+}
+
+func newCatalogImporter(db *gorm.DB, eid int) (*catalogImporter, error) {
+	var catalogs []models.ExCatalog
+	if err := db.Where("eid=?", eid).Order("sort, id").Find(&catalogs).Error; err != nil {
+		return nil, err
+	}
+	var withItems []int
+	if err := db.Model(&models.ExItem{}).Where("eid=?", eid).Distinct("cid").Pluck("cid", &withItems).Error; err != nil {
+		return nil, err
+	}
+
+	root := &importNode{catalog: models.ExCatalog{ExCatalogInput: models.ExCatalogInput{Eid: eid}}, children: map[string]*importNode{}, nextSort: 1}
+	nodes := map[int]*importNode{0: root}
+	for _, catalog := range catalogs {
+		nodes[catalog.ID] = &importNode{catalog: catalog, children: map[string]*importNode{}, nextSort: 1}
+	}
+	for _, cid := range withItems {
+		if node, ok := nodes[cid]; ok && cid != 0 {
+			node.items = true
+		}
+	}
+	for _, catalog := range catalogs {
+		node, parent := nodes[catalog.ID], nodes[catalog.Pid]
+		if parent == nil {
+			continue
+		}
+		node.parent = parent
+		if _, ok := parent.children[catalog.Name]; !ok {
+			parent.children[catalog.Name] = node
+		}
+		if catalog.Sort >= parent.nextSort {
+			parent.nextSort = catalog.Sort + 1
+		}
+	}
+	return &catalogImporter{root: root, byId: nodes, policy: getCatalogPolicy(db, eid)}, nil
+}
+
+// find returns the catalog at path, nil when there is none
+func (im *catalogImporter) find(path []string) *importNode {
+	node := im.root
+	for _, name := range path {
+		if node = node.children[name]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// add places the catalog named by the last name of path, row gets the outcome
+func (im *catalogImporter) add(row *CatalogImportRow, path []string, input models.ExCatalogInput) {
+	row.Path = strings.Join(path, " / ")
+	node, i := im.root, 0
+	for ; i < len(path); i++ {
+		child, ok := node.children[path[i]]
+		if !ok {
+			break
+		}
+		node = child
+	}
+
+	if i == len(path) {
+		switch {
+		case !node.fresh:
+			row.Status, row.ID = "exists", node.catalog.ID
+		case node.row != nil:
+			row.Status, row.Error = "error", fmt.Sprintf("same as row %d", node.row.Row)
+		default:
+			// created as a missing parent of an earlier row
+			node.row = row
+			node.catalog.NameEn, node.catalog.Title, node.catalog.Description = input.NameEn, input.Title, input.Description
+			row.Status = "created"
+		}
+		return
+	}
+	if node.items && im.policy.LeafOnly() {
+		row.Status, row.Error = "error", node.catalog.Name+" has items, it can't have catalogs"
+		return
+	}
+	if im.policy.MaxCatalogDepth > 0 && len(path) > im.policy.MaxCatalogDepth {
+		row.Status, row.Error = "error", fmt.Sprintf("catalogs go %d levels deep at most", im.policy.MaxCatalogDepth)
+		return
+	}
+
+	for ; i < len(path); i++ {
+		node = node.child(path[i])
+		im.fresh = append(im.fresh, node)
+		if i < len(path)-1 {
+			row.Parents = append(row.Parents, path[i])
+		}
+	}
+	node.row = row
+	node.catalog.NameEn, node.catalog.Title, node.catalog.Description = input.NameEn, input.Title, input.Description
+	row.Status = "created"
+}
+
+// create creates the new catalogs, parents first
+func (im *catalogImporter) create(tx *gorm.DB) error {
+	for _, node := range im.fresh {
+		top := node
+		for top.parent != im.root {
+			top = top.parent
+		}
+		node.catalog.Pid = node.parent.catalog.ID
+		if top != node {
+			node.catalog.RootId = top.catalog.ID
+		}
+		if err := tx.Create(&node.catalog).Error; err != nil {
+			return err
+		}
+		if node.row != nil {
+			node.row.ID = node.catalog.ID
+		}
+	}
+	return nil
+}
+
+// readCatalogRows places the rows after the header in the importer and
+// returns their outcome
+func readCatalogRows(im *catalogImporter, rows [][]string) ([]*CatalogImportRow, error) {
+	header := 0
+	for header < len(rows) && strings.Join(rows[header], "") == "" {
+		header++
+	}
+	if header == len(rows) {
+		return nil, errors.New("the spreadsheet is empty")
+	}
+	index := headerIndex(rows[header])
+	column := func(row []string, key string) string {
+		if i, ok := index[key]; ok {
+			return cell(row, i)
+		}
+		return ""
+	}
+
+	var levels []int
+	numbers := map[int]int{}
+	for key, i := range index {
+		if m := levelColumn.FindStringSubmatch(key); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			numbers[i] = n
+			levels = append(levels, i)
+		}
+	}
+	sort.Slice(levels, func(a, b int) bool { return numbers[levels[a]] < numbers[levels[b]] })
+	_, hasPath := index["path"]
+	_, hasName := index["name"]
+	if len(levels) == 0 && !(hasPath && hasName) {
+		return nil, errors.New("the header needs level columns, or path and name columns")
+	}
+
+	var result []*CatalogImportRow
+	above := make([]string, len(levels))
+	for r := header + 1; r < len(rows); r++ {
+		row := rows[r]
+		if strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		outcome := &CatalogImportRow{Row: r + 1}
+		result = append(result, outcome)
+
+		var path []string
+		if len(levels) > 0 {
+			last := -1
+			for l, i := range levels {
+				if cell(row, i) != "" {
+					last = l
+				}
+			}
+			for l := range levels {
+				if l > last {
+					above[l] = ""
+					continue
+				}
+				if name := cell(row, levels[l]); name != "" {
+					above[l] = name
+				}
+				path = append(path, above[l])
+			}
+			if last < 0 {
+				outcome.Status, outcome.Error = "error", "no level is filled"
+				continue
+			}
+			if containsName(path, "") {
+				outcome.Path = strings.Join(path, " / ")
+				outcome.Status, outcome.Error = "error", "a level above is missing"
+				continue
+			}
+		} else {
+			for _, name := range strings.Split(column(row, "path"), "/") {
+				if name = strings.TrimSpace(name); name != "" {
+					path = append(path, name)
+				}
+			}
+			path = append(path, column(row, "name"))
+			if path[len(path)-1] == "" {
+				outcome.Path = strings.Join(path, " / ")
+				outcome.Status, outcome.Error = "error", "name is empty"
+				continue
+			}
+		}
+
+		im.add(outcome, path, models.ExCatalogInput{
+			NameEn:      column(row, "name_en"),
+			Title:       column(row, "title"),
+			Description: column(row, "description"),
+		})
+	}
+	return result, nil
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportExCatalogs godoc
+// @Summary Import catalogs from a spreadsheet
+// @Description An xlsx or CSV file with a header row, then a catalog per row: level 1, level 2, ...
+// @Description columns with the names along its path, or a path column with the names of its parents
+// @Description separated by / and a name column. name_en, title and description are optional. Missing
+// @Description parents are created, existing catalogs are left as they are. Rows against the catalog
+// @Description policy of the exibition are errors. Nothing is created when a row has an error, dry_run
+// @Description only reports what would be done.
+// @Tags catalog
+// @Security BearerAuth
+// @Accept mpfd
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param file formData file true "catalogs.xlsx or catalogs.csv"
+// @Param dry_run query bool false "only report"
+// @Success 200 {object} CatalogImport
+// @Failure 400 {object} CatalogImport
+// @Router /api/{eid}/catalogs/import [put]
+func ImportExCatalogs(c *gin.Context, db *gorm.DB) {
+	eid := GetEid(c)
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
+		return
+	}
+	defer f.Close()
+	rows, err := ReadRows(f, file.Filename, "")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	im, err := newCatalogImporter(db, eid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	report := CatalogImport{DryRun: c.Query("dry_run") == "true"}
+	if report.Rows, err = readCatalogRows(im, rows); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report.Created = len(im.fresh)
+	for _, row := range report.Rows {
+		if row.Status == "error" {
+			report.Errors++
+		}
+	}
+
+	if report.Errors > 0 && !report.DryRun {
+		c.JSON(http.StatusBadRequest, report)
+		return
+	}
+	if !report.DryRun {
+		if err := db.Transaction(im.create); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,206 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"go-http-svc/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// IdMap maps the ids of the source exhibition to the ids of its copy
+type IdMap map[int]int
+
+type cloneResult struct {
+	Exibition models.Exibition `json:"exibition"`
+	Catalogs  IdMap            `json:"catalogs"`
+	Items     IdMap            `json:"items"`
+	Users     IdMap            `json:"users"`
+	// the copied users with their generated initial_password
+	Credentials []models.ExUser `json:"credentials,omitempty"`
+}
+
+// createInactive creates the row and clears is_active afterwards when
+// needed, since gorm replaces a false value by the column default (true).
+func createInactive(tx *gorm.DB, value interface{}, active bool) error {
+	if err := tx.Create(value).Error; err != nil {
+		return err
+	}
+	if !active {
+		return tx.Model(value).Update("is_active", false).Error
+	}
+	return nil
+}
+
+// CloneExibition godoc
+// @Summary Deep copy an exibition
+// @Description Copies the exibition as a draft with its catalog tree and, optionally, its items and
+// @Description its users with new unames and generated passwords. Rates, amounts and comments are
+// @Description not copied. Returns the old id to new id mappings.
+// @Tags exibition
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Exibition ID"
+// @Param clone body models.CloneExibitionInput true "What to copy"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/exibitions/{id}/clone [post]
+func CloneExibition(c *gin.Context, db *gorm.DB) {
+	var source models.Exibition
+	if result := db.First(&source, c.Param("id")); result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "exibition not found"})
+		return
+	}
+	var input models.CloneExibitionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var ret cloneResult
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		ret, err = cloneExibition(tx, &source, &input)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
+func cloneExibition(tx *gorm.DB, source *models.Exibition, input *models.CloneExibitionInput) (cloneResult, error) {
+	ret := cloneResult{Catalogs: IdMap{}, Items: IdMap{}, Users: IdMap{}}
+
+	exibition := models.Exibition{ExibitionInput: source.ExibitionInput, CatalogPolicy: source.CatalogPolicy, Status: models.ExibitionDraft}
+	exibition.Title = input.Title
+	if exibition.Title == "" {
+		exibition.Title = source.Title + " (copy)"
+	}
+	if input.StartTime != nil {
+		exibition.StartTime = *input.StartTime
+	}
+	if input.EndTime != nil {
+		exibition.EndTime = *input.EndTime
+	}
+	if err := createInactive(tx, &exibition, false); err != nil {
+		return ret, err
+	}
+	ret.Exibition = exibition
+	eid := exibition.ID
+
+	var catalogs []models.ExCatalog
+	if err := tx.Where("eid=?", source.ID).Order("id").Find(&catalogs).Error; err != nil {
+		return ret, err
+	}
+	if err := copyCatalogs(tx, catalogs, eid, ret.Catalogs); err != nil {
+		return ret, err
+	}
+
+	var defs []models.ExAttrDef
+	if err := tx.Where("eid=?", source.ID).Order("id").Find(&defs).Error; err != nil {
+		return ret, err
+	}
+	for _, def := range defs {
+		def.ID = 0
+		def.Eid = eid
+		def.Rid = ret.Catalogs[def.Rid]
+		if err := tx.Create(&def).Error; err != nil {
+			return ret, err
+		}
+	}
+
+	if input.Items {
+		var items []models.ExItem
+		if err := tx.Where("eid=?", source.ID).Order("id").Find(&items).Error; err != nil {
+			return ret, err
+		}
+		for _, item := range items {
+			oldId := item.ID
+			item.ID = 0
+			item.Eid = eid
+			item.Cid = ret.Catalogs[item.Cid]
+			if err := createInactive(tx, &item, item.IsActive); err != nil {
+				return ret, err
+			}
+			ret.Items[oldId] = item.ID
+		}
+	}
+
+	if input.Users {
+		var users []models.ExUser
+		if err := tx.Where("eid=?", source.ID).Order("id").Find(&users).Error; err != nil {
+			return ret, err
+		}
+		for i, old := range users {
+			user := models.ExUser{ExUserInput: models.ExUserInput{
+				Eid:    eid,
+				Name:   old.Name,
+				Uname:  generateRandomUsername(5) + strconv.Itoa(i),
+				Title:  old.Title,
+				Mobile: old.Mobile,
+				Role:   models.RoleOfEid(old.EffectiveRole(), eid),
+			}}
+			if err := setInitialPassword(&user, ""); err != nil {
+				return ret, err
+			}
+			if err := createInactive(tx, &user, old.IsActive); err != nil {
+				return ret, err
+			}
+			ret.Users[old.ID] = user.ID
+			ret.Credentials = append(ret.Credentials, user)
+		}
+	}
+	return ret, nil
+}
+
+// copyCatalogs creates the catalogs under exhibition eid, level by level so
+// that parents are created before their children, and remaps Pid and
+// RootId. ids receives the old id to new id mapping.
+func copyCatalogs(tx *gorm.DB, catalogs []models.ExCatalog, eid int, ids IdMap) error {
+	known := map[int]bool{}
+	for _, catalog := range catalogs {
+		known[catalog.ID] = true
+	}
+	var created []models.ExCatalog
+	for pending := catalogs; len(pending) > 0; {
+		var next []models.ExCatalog
+		progress := false
+		for _, catalog := range pending {
+			pid, ok := ids[catalog.Pid]
+			if catalog.Pid != 0 && known[catalog.Pid] && !ok {
+				next = append(next, catalog)
+				continue
+			}
+			// parents outside the set become roots
+			oldId := catalog.ID
+			catalog.ID = 0
+			catalog.Eid = eid
+			catalog.Pid = pid
+			if err := createInactive(tx, &catalog, catalog.IsActive); err != nil {
+				return err
+			}
+			ids[oldId] = catalog.ID
+			created = append(created, catalog)
+			progress = true
+		}
+		// a cycle in pid, can't happen through the API
+		if !progress {
+			break
+		}
+		pending = next
+	}
+	for _, catalog := range created {
+		if rootId := ids[catalog.RootId]; rootId != catalog.RootId {
+			if err := tx.Model(&catalog).Update("root_id", rootId).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
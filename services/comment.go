@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"go-http-svc/models"
 	"net/http"
-	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -24,17 +23,10 @@ import (
 // @Success 200 {array} models.ExComment
 // @Router /api/{eid}/comments/{id} [get]
 func GetExComments(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
 	id := c.Param("id")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatched eid"})
-		return
-	}
 
 	var comments []models.ExComment
-	if result := db.Where("eid=? and iid=?", eid, id).Order("create_time desc").Find(&comments); result.Error != nil {
+	if result := TenantDB(c, db).Where("iid=?", id).Order("create_time desc").Find(&comments); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
 		return
 	}
@@ -51,13 +43,8 @@ func GetExComments(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExComment
 // @Router /api/{eid}/comments/ [put]
 func CreateExComment(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatched eid"})
-		return
-	}
+	eid := GetEid(c)
+	claims := GetClaims(c)
 
 	var input models.ExCommentInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -66,9 +53,16 @@ func CreateExComment(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	input.Uid = claims.UserId
+	input.Eid = eid
+
+	tdb := TenantDB(c, db)
+	if !IsItemExists(tdb, input.Iid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "item not found"})
+		return
+	}
 
 	var comment models.ExComment
-	if result := db.Where("uid=? and iid=? and eid=?", input.Uid, input.Iid, input.Eid).First(&comment); result.Error != nil {
+	if result := tdb.Where("uid=? and iid=?", input.Uid, input.Iid).First(&comment); result.Error != nil {
 		comment = models.ExComment{ExCommentInput: input}
 		if result := db.Create(&comment); result.Error != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": result.Error})
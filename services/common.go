@@ -4,38 +4,27 @@
 package services
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"go-http-svc/models"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"path/filepath"
 
-	"math/rand"
+	mrand "math/rand"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/xuri/excelize/v2"
 )
 
-func IsAdmin(c *gin.Context) bool {
-	claims, ok := c.Get("user")
-	if !ok {
-		fmt.Println("claims not found")
-		return false
-	}
-
-	if claims == nil {
-		fmt.Println("claims nil")
-		return false
-	}
-
-	claim := claims.(*models.Claims)
-	return claim.Eid == 0
-}
-
 func ReadExcel(file_path string) (ret []map[string]string) {
 	f, err := excelize.OpenFile(file_path)
 	if err != nil {
@@ -60,9 +49,9 @@ func ReadExcel(file_path string) (ret []map[string]string) {
 			continue
 		}
 		m := make(map[string]string)
-		m["name"] = row[0]
-		m["title"] = row[1]
-		m["mobile"] = row[2]
+		m["name"] = cell(row, 0)
+		m["title"] = cell(row, 1)
+		m["mobile"] = cell(row, 2)
 
 		ret = append(ret, m)
 		fmt.Println(i, m)
@@ -83,46 +72,96 @@ func ReadExcel(file_path string) (ret []map[string]string) {
 // @Router /api/file_upload [post]
 func UploadFile(c *gin.Context) {
 	// Get the file from the form
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
 		return
 	}
-	file, err := c.FormFile("file")
+
+	src, err := file.Open()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
 		return
 	}
+	defer src.Close()
+
+	// Save the file to a destination
+	url, err := saveUpload(src, file.Filename)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "url": url})
+}
 
-	base := filepath.Base(file.Filename)
-	ext := filepath.Ext(base) // Get the file extension (e.g. .txt)
+// saveUpload stores src in uploads/ under a new UUID name with the
+// extension of name, and returns its url
+func saveUpload(src io.Reader, name string) (string, error) {
+	ext := filepath.Ext(filepath.Base(name)) // Get the file extension (e.g. .txt)
 	newUUID, _ := uuid.NewUUID()
 
 	// Replace the stem with the UUID
 	newFileName := newUUID.String() + ext
 
-	// Save the file to a destination
-	err = c.SaveUploadedFile(file, "./uploads/"+newFileName)
+	if err := os.MkdirAll("./uploads", 0750); err != nil {
+		return "", err
+	}
+	dst, err := os.Create("./uploads/" + newFileName)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to save file"})
-		return
+		return "", err
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully", "url": "uploads/" + newFileName})
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove("./uploads/" + newFileName)
+		return "", err
+	}
+	return "uploads/" + newFileName, nil
 }
 
 func generateRandomUsername(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyz"
 	// Seed the random number generator
-	rand.Seed(time.Now().UnixNano())
+	mrand.Seed(time.Now().UnixNano())
 
 	// Generate a random string of the specified length
 	b := make([]byte, length)
 	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
+		b[i] = charset[mrand.Intn(len(charset))]
 	}
 	return string(b)
 }
 
+// RandomToken returns an url safe random string carrying n bytes of entropy
+func RandomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// HashToken is how opaque tokens are stored at rest
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// baseFields are the columns of models.Base, which partial updates leave
+// alone: deletes and restores go through their own endpoints, so does the
+// activation of users
+var baseFields = []string{"id", "create_time", "update_time", "is_deleted", "is_active"}
+
+// dropBaseFields removes the baseFields from the input of a partial update
+func dropBaseFields(input map[string]interface{}) {
+	for _, key := range baseFields {
+		delete(input, key)
+	}
+}
+
 func ProcessInput(data interface{}) interface{} {
 	switch v := data.(type) {
 	case []interface{}:
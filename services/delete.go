@@ -0,0 +1,290 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"errors"
+	"go-http-svc/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Policies of a delete touching more than the record itself, given by the
+// policy query parameter
+const (
+	// refuse while the record has children, items, rates, amounts or comments
+	DeleteRefuse = "refuse"
+	// delete them too
+	DeleteCascade = "cascade"
+	// move the child catalogs and the items of a catalog to the target catalog
+	DeleteReparent = "reparent"
+)
+
+var errDeleteRefused = errors.New("delete refused")
+
+// DeletePlan is what a delete affects, returned as a preview until the
+// delete is confirmed
+type DeletePlan struct {
+	Policy    string `json:"policy"`
+	Confirmed bool   `json:"confirmed"`
+	Exibition int    `json:"exibition,omitempty"`
+	Catalogs  []int  `json:"catalogs"`
+	Items     []int  `json:"items"`
+	Users     []int  `json:"users,omitempty"`
+	Rates     int64  `json:"rates"`
+	Amounts   int64  `json:"amounts"`
+	Comments  int64  `json:"comments"`
+	// reparent: the catalog the child catalogs and the items move to, 0 for the top level
+	Target        int   `json:"target"`
+	MovedCatalogs []int `json:"moved_catalogs,omitempty"`
+	MovedItems    []int `json:"moved_items,omitempty"`
+}
+
+// others tells whether the delete affects other records than the one deleted
+func (p *DeletePlan) others() bool {
+	records := len(p.Catalogs) + len(p.Items) + len(p.Users)
+	if p.Exibition == 0 {
+		// the catalog or the item deleted
+		records--
+	}
+	return records > 0 || p.Rates+p.Amounts+p.Comments > 0 || len(p.MovedCatalogs)+len(p.MovedItems) > 0
+}
+
+// countFeedback fills the counts of the rates, amounts and comments of the
+// items of the plan, or of the whole exhibition
+func (p *DeletePlan) countFeedback(tx *gorm.DB) {
+	counts := []*int64{&p.Rates, &p.Amounts, &p.Comments}
+	for i, model := range feedbackModels {
+		query := tx.Model(model())
+		if p.Exibition != 0 {
+			query = query.Where("eid=?", p.Exibition)
+		} else if len(p.Items) > 0 {
+			query = query.Where("iid in ?", p.Items)
+		} else {
+			continue
+		}
+		query.Count(counts[i])
+	}
+}
+
+// apply soft deletes and moves what the plan says
+func (p *DeletePlan) apply(tx *gorm.DB) error {
+	if p.Exibition != 0 {
+		// the exhibition first, RestoreTrash restores what was deleted after it
+		if err := tx.Delete(&models.Exibition{}, p.Exibition).Error; err != nil {
+			return err
+		}
+		for _, model := range exibitionContent {
+			if err := tx.Where("eid=?", p.Exibition).Delete(model()).Error; err != nil {
+				return err
+			}
+		}
+		for _, model := range exibitionAccess {
+			if err := tx.Model(model()).Where("eid=? and is_active=?", p.Exibition, true).Update("is_active", false).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, id := range p.MovedCatalogs {
+		var catalog models.ExCatalog
+		if err := tx.First(&catalog, id).Error; err != nil {
+			return err
+		}
+		if err := moveCatalog(tx, &catalog, p.Target); err != nil {
+			return err
+		}
+	}
+	if len(p.MovedItems) > 0 {
+		if err := tx.Model(&models.ExItem{}).Where("id in ?", p.MovedItems).Update("cid", p.Target).Error; err != nil {
+			return err
+		}
+	}
+	// parents before children, RestoreTrash restores what was deleted after the parent
+	if len(p.Catalogs) > 0 {
+		if err := tx.Where("id in ?", p.Catalogs).Delete(&models.ExCatalog{}).Error; err != nil {
+			return err
+		}
+	}
+	if len(p.Items) > 0 {
+		if err := tx.Where("id in ?", p.Items).Delete(&models.ExItem{}).Error; err != nil {
+			return err
+		}
+		for _, model := range feedbackModels {
+			if err := tx.Where("iid in ?", p.Items).Delete(model()).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// catalogSubtree returns the ids of the catalogs under catalog id, deleted
+// ones excluded
+func catalogSubtree(tx *gorm.DB, eid int, id int) ([]int, error) {
+	var ids []int
+	err := tx.Raw(`
+		WITH RECURSIVE child_tree AS (
+			SELECT id FROM ex_catalogs WHERE pid = ? and eid = ? and is_deleted = false
+			UNION ALL
+			SELECT n.id FROM ex_catalogs n
+			INNER JOIN child_tree ct ON n.pid = ct.id
+			WHERE n.eid = ? and n.is_deleted = false
+		)
+		SELECT id FROM child_tree;
+	`, id, eid, eid).Scan(&ids).Error
+	return ids, err
+}
+
+// deletedWithCatalog returns the ids of the catalogs under catalog id and of
+// their items that were deleted with it, at or after since
+func deletedWithCatalog(tx *gorm.DB, id int, since time.Time) (catalogs []int, items []int, err error) {
+	err = tx.Raw(`
+		WITH RECURSIVE child_tree AS (
+			SELECT id FROM ex_catalogs WHERE pid = ? and is_deleted = true and update_time >= ?
+			UNION ALL
+			SELECT n.id FROM ex_catalogs n
+			INNER JOIN child_tree ct ON n.pid = ct.id
+			WHERE n.is_deleted = true and n.update_time >= ?
+		)
+		SELECT id FROM child_tree;
+	`, id, since, since).Scan(&catalogs).Error
+	if err != nil {
+		return
+	}
+	err = tx.Unscoped().Model(&models.ExItem{}).
+		Where("cid in ? and is_deleted=? and update_time>=?", append([]int{id}, catalogs...), true, since).
+		Pluck("id", &items).Error
+	return
+}
+
+func planCatalogDelete(tx *gorm.DB, catalog *models.ExCatalog, policy string, target int) (*DeletePlan, error) {
+	plan := &DeletePlan{Policy: policy, Catalogs: []int{catalog.ID}, Items: []int{}}
+	var children, items []int
+	if err := tx.Model(&models.ExCatalog{}).Where("pid=?", catalog.ID).Pluck("id", &children).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&models.ExItem{}).Where("cid=?", catalog.ID).Pluck("id", &items).Error; err != nil {
+		return nil, err
+	}
+
+	switch policy {
+	case DeleteRefuse:
+		if len(children)+len(items) > 0 {
+			plan.Catalogs, plan.Items = append(plan.Catalogs, children...), items
+			return plan, errDeleteRefused
+		}
+	case DeleteCascade:
+		subtree, err := catalogSubtree(tx, catalog.Eid, catalog.ID)
+		if err != nil {
+			return nil, err
+		}
+		plan.Catalogs = append(plan.Catalogs, subtree...)
+		if err := tx.Model(&models.ExItem{}).Where("cid in ?", plan.Catalogs).Pluck("id", &plan.Items).Error; err != nil {
+			return nil, err
+		}
+		plan.countFeedback(tx)
+	case DeleteReparent:
+		if target == 0 && len(items) > 0 {
+			return nil, errors.New("items need a target catalog")
+		}
+		if target != 0 {
+			subtree, err := catalogSubtree(tx, catalog.Eid, catalog.ID)
+			if err != nil {
+				return nil, err
+			}
+			if target == catalog.ID || containsId(subtree, target) || !IsCatalogExists(tx, target) {
+				return nil, errors.New("invalid target catalog")
+			}
+		}
+		if err := checkMovedPlacement(tx, catalog, target, children, items); err != nil {
+			return nil, err
+		}
+		plan.Target = target
+		plan.MovedCatalogs, plan.MovedItems = children, items
+	default:
+		return nil, errors.New("invalid policy " + policy)
+	}
+	return plan, nil
+}
+
+func planItemDelete(tx *gorm.DB, item *models.ExItem, policy string) (*DeletePlan, error) {
+	plan := &DeletePlan{Policy: policy, Catalogs: []int{}, Items: []int{item.ID}}
+	plan.countFeedback(tx)
+	switch policy {
+	case DeleteRefuse:
+		if plan.others() {
+			return plan, errDeleteRefused
+		}
+	case DeleteCascade:
+	default:
+		return nil, errors.New("invalid policy " + policy)
+	}
+	return plan, nil
+}
+
+func planExibitionDelete(tx *gorm.DB, exibition *models.Exibition, policy string) (*DeletePlan, error) {
+	plan := &DeletePlan{Policy: policy, Exibition: exibition.ID}
+	for model, ids := range map[interface{}]*[]int{
+		&models.ExCatalog{}: &plan.Catalogs, &models.ExItem{}: &plan.Items, &models.ExUser{}: &plan.Users,
+	} {
+		if err := tx.Model(model).Where("eid=?", exibition.ID).Pluck("id", ids).Error; err != nil {
+			return nil, err
+		}
+	}
+	plan.countFeedback(tx)
+	switch policy {
+	case DeleteRefuse:
+		if plan.others() {
+			return plan, errDeleteRefused
+		}
+	case DeleteCascade:
+	default:
+		return nil, errors.New("invalid policy " + policy)
+	}
+	return plan, nil
+}
+
+func containsId(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// runDelete answers a delete request for the plan: refused deletes get a
+// 409 with what's in the way, deletes touching other records only preview
+// them unless confirm=true, and the rest is applied by apply.
+func runDelete(c *gin.Context, db *gorm.DB, plan *DeletePlan, err error, apply func(tx *gorm.DB) error) {
+	if errors.Is(err, errDeleteRefused) {
+		c.JSON(http.StatusConflict, gin.H{"error": "not empty, delete with policy=cascade or policy=reparent", "plan": plan})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if plan.others() && c.Query("confirm") != "true" {
+		c.JSON(http.StatusOK, plan)
+		return
+	}
+	if err := db.Transaction(apply); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	plan.Confirmed = true
+	c.JSON(http.StatusOK, plan)
+}
+
+func deletePolicy(c *gin.Context) (string, int) {
+	target, _ := strconv.Atoi(c.Query("target"))
+	return c.DefaultQuery("policy", DeleteRefuse), target
+}
@@ -45,11 +45,6 @@ func GetExibitions(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.Exibition
 // @Router /api/exibitions [put]
 func CreateExibition(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
 	var input models.ExibitionInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -57,10 +52,12 @@ func CreateExibition(c *gin.Context, db *gorm.DB) {
 	}
 	exibition := models.Exibition{
 		ExibitionInput: input,
+		Status:         models.ExibitionDraft,
 	}
 
-	if result := db.Create(&exibition); result.Error != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": result.Error})
+	// not current until opened or activated, see activateExibition
+	if err := createInactive(db, &exibition, false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err})
 		return
 	}
 	c.JSON(http.StatusOK, exibition)
@@ -95,11 +92,6 @@ func GetExibition(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.Exibition
 // @Router /api/exibitions/{id} [patch]
 func UpdateExibition(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
 	id := c.Param("id")
 	var exibition models.Exibition
 	if result := db.First(&exibition, id); result.Error != nil {
@@ -113,6 +105,13 @@ func UpdateExibition(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
+	// the status only changes through SetExibitionStatus, the catalog
+	// policy through SetCatalogPolicy, the active exibition through
+	// SetActiveExibition and the deletion through DeleteExibition
+	input.Status = ""
+	input.CatalogPolicy = models.CatalogPolicy{}
+	input.Base = models.Base{}
+
 	// Use GORM’s Updates method to perform a partial update
 	if err := db.Model(&exibition).Updates(input).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -125,25 +124,34 @@ func UpdateExibition(c *gin.Context, db *gorm.DB) {
 
 // DeleteExibition godoc
 // @Summary Delete an exibition by ID
+// @Description An exibition with catalogs, items, users, rates, amounts or comments is only deleted
+// @Description with policy cascade, deleting them too, which returns what would be affected until
+// @Description confirm=true.
 // @Tags exibition
 // @Security BearerAuth
+// @Produce json
 // @Param id path int true "Exibition ID"
-// @Success 200
+// @Param policy query string false "refuse (default) or cascade"
+// @Param confirm query bool false "apply the delete"
+// @Success 200 {object} DeletePlan
+// @Failure 409 {object} map[string]interface{}
 // @Router /api/exibitions/{id} [delete]
 func DeleteExibition(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
 	id := c.Param("id")
 	var exibition models.Exibition
 	if result := db.First(&exibition, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "exibition not found"})
 		return
 	}
-	db.Delete(&exibition)
-	c.JSON(http.StatusOK, gin.H{"message": "exibition deleted successfully"})
+	policy, _ := deletePolicy(c)
+	plan, err := planExibitionDelete(db, &exibition, policy)
+	// soft, its data stays unreachable until it's restored, see RestoreTrash
+	runDelete(c, db, plan, err, func(tx *gorm.DB) error {
+		if err := deactivateExibitions(tx, "id=?", exibition.ID, GetClaims(c).UserId, "deleted"); err != nil {
+			return err
+		}
+		return plan.apply(tx)
+	})
 }
 
 // GetExibition godoc
@@ -163,7 +171,8 @@ func GetActiveExibition(c *gin.Context, db *gorm.DB) {
 }
 
 // SetActiveExibition godoc
-// @Summary Update an exibition by ID
+// @Summary Make an exibition the current one
+// @Description The current exibition is the only active one, the others are deactivated
 // @Tags exibition
 // @Security BearerAuth
 // @Produce json
@@ -171,21 +180,36 @@ func GetActiveExibition(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.Exibition
 // @Router /api/ex_active/{eid} [post]
 func SetActiveExibition(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
 	eid := c.Param("eid")
 	var exibition models.Exibition
 	if result := db.Where("id=?", eid).Order("update_time desc").First(&exibition); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "exibition not found"})
 		return
 	}
-	if result := db.Model(&exibition).Update("is_active", true); result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return activateExibition(tx, exibition.ID, GetClaims(c).UserId, "manual")
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	db.First(&exibition, exibition.ID)
 	c.JSON(http.StatusOK, exibition)
 }
+
+// GetExibitionTransitions godoc
+// @Summary Get the status and activation history of an exibition
+// @Tags exibition
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Exibition ID"
+// @Success 200 {array} models.ExibitionTransition
+// @Router /api/exibitions/{id}/transitions [get]
+func GetExibitionTransitions(c *gin.Context, db *gorm.DB) {
+	var transitions []models.ExibitionTransition
+	if result := db.Where("eid=?", c.Param("id")).Order("id desc").Find(&transitions); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, transitions)
+}
@@ -0,0 +1,479 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-http-svc/models"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// An item spreadsheet has a header row, then an item per row with the
+// columns name, description, catalog (the path of the catalog, names
+// separated by "/") or cid, and images and thumbnails (file names in the
+// image zip, separated by "," or ";"). Any other column is an extra
+// attribute, see ExItemInput.Attrs, read as the type of its ExAttrDef if it
+// has one. Without images, the images whose name
+// is the item name, alone or followed by "_", "-" or a space and a suffix,
+// are used, and without thumbnails the first image.
+
+var itemColumns = map[string]bool{
+	"name": true, "description": true, "catalog": true, "cid": true, "images": true, "thumbnails": true,
+}
+
+var imageExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true}
+
+// ItemImportRow is the outcome of a row of an item import
+type ItemImportRow struct {
+	// row number in the spreadsheet, from 1
+	Row    int      `json:"row"`
+	Name   string   `json:"name"`
+	Cid    int      `json:"cid"`
+	ID     int      `json:"id,omitempty"`
+	Status string   `json:"status"`
+	Error  string   `json:"error,omitempty"`
+	Images []string `json:"images,omitempty"`
+	// the images in the zip and the item to create, filled by readItemRows
+	images     []*zip.File
+	thumbnails []*zip.File
+	item       models.ExItem
+}
+
+// ItemImport is the report of an item import
+type ItemImport struct {
+	DryRun  bool             `json:"dry_run"`
+	Created int              `json:"created"`
+	Errors  int              `json:"errors"`
+	Rows    []*ItemImportRow `json:"rows"`
+	// images of the zip no row uses
+	Unused []string `json:"unused_images,omitempty"`
+}
+
+var errImageTooLarge = errors.New("image too large")
+
+// imageIndex finds the images of a zip by file name, case insensitively
+type imageIndex struct {
+	files map[string]*zip.File
+	names []string
+	used  map[string]bool
+	// taken by match, not matched again
+	matched map[string]bool
+}
+
+func newImageIndex(zr *zip.Reader) *imageIndex {
+	index := &imageIndex{files: map[string]*zip.File{}, used: map[string]bool{}, matched: map[string]bool{}}
+	if zr == nil {
+		return index
+	}
+	for _, f := range zr.File {
+		name := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(f.Name, "__MACOSX/") ||
+			!imageExts[strings.ToLower(path.Ext(name))] {
+			continue
+		}
+		key := strings.ToLower(name)
+		if _, ok := index.files[key]; !ok {
+			index.files[key] = f
+			index.names = append(index.names, key)
+		}
+	}
+	sort.Strings(index.names)
+	return index
+}
+
+// list returns the images named in a cell
+func (ix *imageIndex) list(value string) ([]*zip.File, error) {
+	var files []*zip.File
+	for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' || r == '\n' }) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f, ok := ix.files[strings.ToLower(path.Base(name))]
+		if !ok {
+			return nil, fmt.Errorf("image %s is not in the zip", name)
+		}
+		ix.used[strings.ToLower(path.Base(name))] = true
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// match returns the images named after the item, the item name alone or
+// followed by "_", "-" or a space and a number, that no other item matched
+func (ix *imageIndex) match(item string) []*zip.File {
+	var files []*zip.File
+	item = strings.ToLower(item)
+	for _, key := range ix.names {
+		stem := strings.TrimSuffix(key, path.Ext(key))
+		rest, ok := strings.CutPrefix(stem, item)
+		if !ok || ix.matched[key] {
+			continue
+		}
+		if rest != "" {
+			number := rest[1:]
+			if !strings.ContainsAny(rest[:1], "_- ") || number == "" || strings.Trim(number, "0123456789") != "" {
+				continue
+			}
+		}
+		ix.used[key] = true
+		ix.matched[key] = true
+		files = append(files, ix.files[key])
+	}
+	return files
+}
+
+// checkImageSizes refuses images larger than maxBundleEntry
+func checkImageSizes(lists ...[]*zip.File) error {
+	for _, files := range lists {
+		for _, f := range files {
+			if f.UncompressedSize64 > maxBundleEntry {
+				return fmt.Errorf("%w: %s", errImageTooLarge, f.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (ix *imageIndex) unused() []string {
+	var names []string
+	for _, key := range ix.names {
+		if !ix.used[key] {
+			names = append(names, ix.files[key].Name)
+		}
+	}
+	return names
+}
+
+// readItemRows checks the rows after the header, placing the items in the
+// catalogs of im and their images in images
+func readItemRows(im *catalogImporter, existing map[int]map[string]int, images *imageIndex, schema attrSchema, eid int, rows [][]string) ([]*ItemImportRow, error) {
+	header := 0
+	for header < len(rows) && strings.Join(rows[header], "") == "" {
+		header++
+	}
+	if header == len(rows) {
+		return nil, errors.New("the spreadsheet is empty")
+	}
+	index := headerIndex(rows[header])
+	if _, ok := index["name"]; !ok {
+		return nil, errors.New("the header needs a name column")
+	}
+	column := func(row []string, key string) string {
+		if i, ok := index[key]; ok {
+			return cell(row, i)
+		}
+		return ""
+	}
+
+	var result []*ItemImportRow
+	seen := map[int]map[string]int{}
+	for r := header + 1; r < len(rows); r++ {
+		row := rows[r]
+		if strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		outcome := &ItemImportRow{Row: r + 1, Name: column(row, "name"), Status: "error"}
+		result = append(result, outcome)
+		if outcome.Name == "" {
+			outcome.Error = "name is empty"
+			continue
+		}
+
+		if value := column(row, "cid"); value != "" {
+			cid, err := strconv.Atoi(value)
+			if _, ok := im.byId[cid]; err != nil || !ok || cid == 0 {
+				outcome.Error = "catalog " + value + " not found"
+				continue
+			}
+			outcome.Cid = cid
+		} else if value := column(row, "catalog"); value != "" {
+			var names []string
+			for _, name := range strings.Split(value, "/") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+			node := im.find(names)
+			if node == nil || node == im.root {
+				outcome.Error = "catalog " + value + " not found"
+				continue
+			}
+			outcome.Cid = node.catalog.ID
+		}
+		if outcome.Cid != 0 && im.policy.LeafOnly() && len(im.byId[outcome.Cid].children) > 0 {
+			outcome.Error = "catalog has child catalogs, items only go in catalogs without them"
+			continue
+		}
+		if id, ok := existing[outcome.Cid][outcome.Name]; ok {
+			outcome.Status, outcome.ID = "exists", id
+			continue
+		}
+		if seen[outcome.Cid] == nil {
+			seen[outcome.Cid] = map[string]int{}
+		}
+		if first, ok := seen[outcome.Cid][outcome.Name]; ok {
+			outcome.Error = fmt.Sprintf("same as row %d", first)
+			continue
+		}
+		seen[outcome.Cid][outcome.Name] = outcome.Row
+
+		var err error
+		if value := column(row, "images"); value != "" {
+			outcome.images, err = images.list(value)
+		} else {
+			outcome.images = images.match(outcome.Name)
+		}
+		if err == nil {
+			outcome.thumbnails, err = images.list(column(row, "thumbnails"))
+		}
+		if err == nil {
+			err = checkImageSizes(outcome.images, outcome.thumbnails)
+		}
+		if err != nil {
+			outcome.Error = err.Error()
+			continue
+		}
+		if len(outcome.thumbnails) == 0 && len(outcome.images) > 0 {
+			outcome.thumbnails = outcome.images[:1]
+		}
+		for _, f := range outcome.images {
+			outcome.Images = append(outcome.Images, f.Name)
+		}
+
+		attrs := map[string]interface{}{}
+		for key, i := range index {
+			if value := cell(row, i); !itemColumns[key] && value != "" {
+				attrs[key] = value
+				if def := schema.find(key); def != nil {
+					attrs[key], err = parseAttr(def, value)
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		// the top level catalog, whose attributes the item has
+		root := im.byId[outcome.Cid]
+		for root.parent != nil && root.parent != im.root {
+			root = root.parent
+		}
+		var data json.RawMessage
+		if err == nil {
+			data, err = schema.check(root.catalog.ID, attrs)
+		}
+		if err != nil {
+			outcome.Error = err.Error()
+			continue
+		}
+		outcome.item = models.ExItem{ExItemInput: models.ExItemInput{
+			Eid:         eid,
+			Name:        outcome.Name,
+			Description: column(row, "description"),
+			Cid:         outcome.Cid,
+		}}
+		outcome.item.Attrs = data
+		outcome.Status = "created"
+	}
+	return result, nil
+}
+
+// saveImages stores the images of the rows in uploads/, once each, and
+// fills Images and Thumbnails of their items with the urls. It returns the
+// urls stored, for removeUploads when the items aren't created after all.
+func saveImages(rows []*ItemImportRow) ([]string, error) {
+	urls := map[*zip.File]string{}
+	var saved []string
+	save := func(files []*zip.File) (json.RawMessage, error) {
+		list := []string{}
+		for _, f := range files {
+			if _, ok := urls[f]; !ok {
+				src, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				// one byte more than allowed tells a larger file from the limit
+				url, err := saveUpload(io.LimitReader(src, maxBundleEntry+1), f.Name)
+				src.Close()
+				if err != nil {
+					return nil, err
+				}
+				saved = append(saved, url)
+				if info, err := os.Stat(url); err != nil || info.Size() > maxBundleEntry {
+					return nil, fmt.Errorf("%w: %s", errImageTooLarge, f.Name)
+				}
+				urls[f] = url
+			}
+			list = append(list, urls[f])
+		}
+		return json.Marshal(list)
+	}
+
+	var err error
+	for _, row := range rows {
+		if row.Status != "created" || len(row.images)+len(row.thumbnails) == 0 {
+			continue
+		}
+		if row.item.Images, err = save(row.images); err == nil {
+			row.item.Thumbnails, err = save(row.thumbnails)
+		}
+		if err != nil {
+			if errors.Is(err, errImageTooLarge) {
+				row.Status, row.Error = "error", err.Error()
+			}
+			removeUploads(saved)
+			return nil, err
+		}
+	}
+	return saved, nil
+}
+
+// removeUploads removes the files stored by saveUpload
+func removeUploads(urls []string) {
+	for _, url := range urls {
+		os.Remove(url)
+	}
+}
+
+// ImportExItems godoc
+// @Summary Import items from a spreadsheet
+// @Description An xlsx or CSV file with a header row, then an item per row: name, description, catalog
+// @Description (catalog path, names separated by /) or cid, images and thumbnails (file names in the
+// @Description images zip, separated by , or ;). Other columns are stored in attrs, checked against the
+// @Description attributes of the exibition. Without images the
+// @Description images named after the item are used, name.jpg, name_1.jpg, ..., up to 256 MB each, and without thumbnails
+// @Description the first image. Items already in their catalog are left as they are. Nothing is created
+// @Description when a row has an error, dry_run only reports what would be done.
+// @Tags item
+// @Security BearerAuth
+// @Accept mpfd
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param file formData file true "items.xlsx or items.csv"
+// @Param images formData file false "zip of the images"
+// @Param dry_run query bool false "only report"
+// @Success 200 {object} ItemImport
+// @Failure 400 {object} ItemImport
+// @Router /api/{eid}/items/import [put]
+func ImportExItems(c *gin.Context, db *gorm.DB) {
+	eid := GetEid(c)
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
+		return
+	}
+	defer f.Close()
+	rows, err := ReadRows(f, file.Filename, "")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var zr *zip.Reader
+	if archive, err := c.FormFile("images"); err == nil {
+		af, err := archive.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload images"})
+			return
+		}
+		defer af.Close()
+		if zr, err = zip.NewReader(af, archive.Size); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "images is not a zip: " + err.Error()})
+			return
+		}
+	}
+
+	im, err := newCatalogImporter(db, eid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var items []models.ExItem
+	if err := db.Select("id, cid, name").Where("eid=?", eid).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	existing := map[int]map[string]int{}
+	for _, item := range items {
+		if existing[item.Cid] == nil {
+			existing[item.Cid] = map[string]int{}
+		}
+		existing[item.Cid][item.Name] = item.ID
+	}
+
+	images := newImageIndex(zr)
+	report := ItemImport{DryRun: c.Query("dry_run") == "true"}
+	schema, err := loadAttrSchema(db, eid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if report.Rows, err = readItemRows(im, existing, images, schema, eid, rows); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report.Unused = images.unused()
+	for _, row := range report.Rows {
+		switch row.Status {
+		case "created":
+			report.Created++
+		case "error":
+			report.Errors++
+		}
+	}
+
+	if report.Errors > 0 && !report.DryRun {
+		c.JSON(http.StatusBadRequest, report)
+		return
+	}
+	if !report.DryRun {
+		saved, err := saveImages(report.Rows)
+		if errors.Is(err, errImageTooLarge) {
+			report.Created--
+			report.Errors++
+			c.JSON(http.StatusBadRequest, report)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for _, row := range report.Rows {
+				if row.Status != "created" {
+					continue
+				}
+				row.item.Sort = nextSort(tx.Where("eid=?", eid), &models.ExItem{}, "cid", row.Cid)
+				if err := tx.Create(&row.item).Error; err != nil {
+					return err
+				}
+				row.ID = row.item.ID
+			}
+			return nil
+		})
+		if err != nil {
+			removeUploads(saved)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,195 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"errors"
+	"go-http-svc/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// TransitionExibition moves the exhibition to status to, freezing the
+// results when it closes. The update is conditional on the status read
+// so that concurrent transitions can't both apply. uid is the user asking
+// for it, 0 for the scheduler.
+func TransitionExibition(db *gorm.DB, exibition *models.Exibition, to string, uid int, reason string) error {
+	from := exibition.Status
+	if !models.CanTransition(from, to) {
+		return ErrInvalidTransition
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(exibition).Where("status=?", from).Update("status", to)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidTransition
+		}
+		if err := tx.Create(&models.ExibitionTransition{
+			Eid: exibition.ID, Kind: models.TransitionStatus, From: from, To: to, Uid: uid, Reason: reason,
+		}).Error; err != nil {
+			return err
+		}
+
+		switch to {
+		case models.ExibitionOpen:
+			// an exhibition opening becomes the current one
+			return activateExibition(tx, exibition.ID, uid, reason)
+		case models.ExibitionClosed:
+			return freezeResults(tx, exibition.ID)
+		case models.ExibitionArchived:
+			return deactivateExibitions(tx, "id=?", exibition.ID, uid, reason)
+		}
+		return nil
+	})
+}
+
+// activateExibition makes eid the current exhibition: it's the only one
+// active, every other exhibition is deactivated.
+func activateExibition(tx *gorm.DB, eid int, uid int, reason string) error {
+	if err := deactivateExibitions(tx, "id<>?", eid, uid, reason); err != nil {
+		return err
+	}
+	result := tx.Model(&models.Exibition{}).Where("id=? and is_active=?", eid, false).Update("is_active", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return tx.Create(&models.ExibitionTransition{
+			Eid: eid, Kind: models.TransitionActive, From: "false", To: "true", Uid: uid, Reason: reason,
+		}).Error
+	}
+	return nil
+}
+
+// deactivateExibitions deactivates the active exhibitions matching cond,
+// "id=?" or "id<>?" with eid
+func deactivateExibitions(tx *gorm.DB, cond string, eid int, uid int, reason string) error {
+	var ids []int
+	if err := tx.Model(&models.Exibition{}).Where("is_active=?", true).Where(cond, eid).Pluck("id", &ids).Error; err != nil || len(ids) == 0 {
+		return err
+	}
+	if err := tx.Model(&models.Exibition{}).Where("id in ?", ids).Update("is_active", false).Error; err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := tx.Create(&models.ExibitionTransition{
+			Eid: id, Kind: models.TransitionActive, From: "true", To: "false", Uid: uid, Reason: reason,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// freezeResults replaces the result snapshot of the exhibition with the
+// current rates, amounts and comments of its items, ranked by rate.
+func freezeResults(tx *gorm.DB, eid int) error {
+	var results []models.ExItemResult
+	if err := tx.Table("ex_items").
+		Select("ex_items.id as iid, ex_items.cid, ex_items.name, COALESCE(rates.avg_rate, 0) as avg_rate, COALESCE(rates.rate_count, 0) as rate_count, "+
+			"COALESCE(amounts.sum_amount, 0) as sum_amount, COALESCE(amounts.orders, 0) as orders, COALESCE(comments.comments, 0) as comments").
+		Joins("LEFT JOIN (SELECT iid, AVG(rate) as avg_rate, COUNT(*) as rate_count FROM ex_rates WHERE eid = ? and is_deleted = false GROUP BY iid) as rates ON rates.iid = ex_items.id", eid).
+		Joins("LEFT JOIN (SELECT iid, SUM(amount) as sum_amount, SUM(amount > 0) as orders FROM ex_amounts WHERE eid = ? and is_deleted = false GROUP BY iid) as amounts ON amounts.iid = ex_items.id", eid).
+		Joins("LEFT JOIN (SELECT iid, COUNT(*) as comments FROM ex_comments WHERE eid = ? and is_deleted = false GROUP BY iid) as comments ON comments.iid = ex_items.id", eid).
+		Where("ex_items.eid = ? and ex_items.is_deleted = false", eid).
+		Order("avg_rate desc, rate_count desc, ex_items.id").
+		Scan(&results).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Unscoped().Where("eid=?", eid).Delete(&models.ExItemResult{}).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range results {
+		results[i].Eid = eid
+		results[i].Rank = i + 1
+		results[i].FrozenAt = now
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	return tx.CreateInBatches(&results, 100).Error
+}
+
+// SetExibitionStatus godoc
+// @Summary Change the status of an exibition
+// @Description Allowed transitions: draft->published, published->draft|open, open->closed,
+// @Description closed->open|archived. Closing freezes the results, see /api/{eid}/results.
+// @Tags exibition
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param id path int true "Exibition ID"
+// @Param status body models.ExibitionStatusInput true "New status"
+// @Success 200 {object} models.Exibition
+// @Failure 409 {object} map[string]interface{}
+// @Router /api/exibitions/{id}/status [post]
+func SetExibitionStatus(c *gin.Context, db *gorm.DB) {
+	id := c.Param("id")
+	var exibition models.Exibition
+	if result := db.First(&exibition, id); result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "exibition not found"})
+		return
+	}
+	var input models.ExibitionStatusInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	from := exibition.Status
+	if err := TransitionExibition(db, &exibition, input.Status, GetClaims(c).UserId, "manual"); err != nil {
+		if errors.Is(err, ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, gin.H{"error": "can not change status from " + from + " to " + input.Status})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, exibition)
+}
+
+// RequireExibitionOpen refuses the request unless the exhibition of the
+// /:eid route is open, for the writes of judges and buyers
+func RequireExibitionOpen(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var exibition models.Exibition
+		if result := db.Select("id, status").First(&exibition, GetEid(c)); result.Error != nil || exibition.Status != models.ExibitionOpen {
+			c.JSON(http.StatusConflict, gin.H{"error": "exibition is not open"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetExItemResults godoc
+// @Summary Get the frozen results of a closed exibition
+// @Description Items ranked by average rate, as they were when the exibition closed
+// @Tags stats
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Success 200 {array} models.ExItemResult
+// @Router /api/{eid}/results [get]
+func GetExItemResults(c *gin.Context, db *gorm.DB) {
+	var results []models.ExItemResult
+	if result := TenantDB(c, db).Order("`rank`").Find(&results); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	if len(results) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no results, the exibition hasn't closed yet"})
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,132 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"go-http-svc/models"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Failed logins are counted per username and per client ip. Every failure
+// delays the next attempt exponentially (1s, 2s, 4s...), after
+// LOGIN_MAX_FAILURES failures the username is locked for LOGIN_LOCKOUT.
+// An ip, shared by all the judges of a venue, gets 4 times more attempts.
+// Counters restart once no failure happened for LOGIN_LOCKOUT.
+func loginMaxFailures(kind string) int {
+	n, err := strconv.Atoi(os.Getenv("LOGIN_MAX_FAILURES"))
+	if err != nil || n <= 0 {
+		n = 5
+	}
+	if kind == models.LoginFailureIp {
+		n *= 4
+	}
+	return n
+}
+
+func loginLockout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("LOGIN_LOCKOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+// LoginRetryAfter tells how long the login of uname from ip is refused, 0 if allowed
+func LoginRetryAfter(db *gorm.DB, uname, ip string) time.Duration {
+	var failures []models.ExLoginFailure
+	db.Where("(kind=? and `key`=?) or (kind=? and `key`=?)",
+		models.LoginFailureUser, uname, models.LoginFailureIp, ip).Find(&failures)
+
+	var wait time.Duration
+	for _, failure := range failures {
+		if d := time.Until(failure.LockedUntil); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// RecordLoginFailure counts a failed login of uname from ip
+func RecordLoginFailure(db *gorm.DB, uname, ip string) {
+	recordFailure(db, models.LoginFailureUser, uname)
+	recordFailure(db, models.LoginFailureIp, ip)
+}
+
+func recordFailure(db *gorm.DB, kind, key string) {
+	now := time.Now()
+	// the counter restarts after a quiet period, failures is assigned
+	// before last_failure since mysql evaluates the assignments in order
+	db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "kind"}, {Name: "key"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "failures"}, Value: gorm.Expr("if(last_failure < ?, 1, failures + 1)", now.Add(-loginLockout()))},
+			{Column: clause.Column{Name: "last_failure"}, Value: now},
+		},
+	}).Create(&models.ExLoginFailure{Kind: kind, Key: key, Failures: 1, LastFailure: now, LockedUntil: now})
+
+	var failure models.ExLoginFailure
+	if err := db.Where("kind=? and `key`=?", kind, key).First(&failure).Error; err != nil {
+		return
+	}
+	lockedUntil := now.Add(loginLockout())
+	if failure.Failures < loginMaxFailures(kind) {
+		lockedUntil = now.Add(time.Second << min(failure.Failures-1, 16))
+	}
+	db.Model(&failure).Update("locked_until", lockedUntil)
+}
+
+// ResetLoginFailures clears the counter of uname after a successful login
+func ResetLoginFailures(db *gorm.DB, uname string) {
+	db.Unscoped().Where("kind=? and `key`=?", models.LoginFailureUser, uname).Delete(&models.ExLoginFailure{})
+}
+
+// GetLockouts godoc
+// @Summary Get the failed login counters
+// @Description Usernames and client ips with recent failed logins, locked_until tells until when the login is refused
+// @Tags auth
+// @Security BearerAuth
+// @Produce json
+// @Param locked query bool false "only the ones currently locked"
+// @Success 200 {array} models.ExLoginFailure
+// @Router /api/lockouts [get]
+func GetLockouts(c *gin.Context, db *gorm.DB) {
+	query := db.Where("last_failure>?", time.Now().Add(-loginLockout())).Order("locked_until desc")
+	if locked, _ := strconv.ParseBool(c.Query("locked")); locked {
+		query = db.Where("locked_until>?", time.Now()).Order("locked_until desc")
+	}
+
+	var failures []models.ExLoginFailure
+	if result := query.Find(&failures); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, failures)
+}
+
+// DeleteLockout godoc
+// @Summary Clear a failed login counter, unlocking the username or ip
+// @Tags auth
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "models.ExLoginFailure ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/lockouts/{id} [delete]
+func DeleteLockout(c *gin.Context, db *gorm.DB) {
+	result := db.Unscoped().Delete(&models.ExLoginFailure{}, c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "lockout not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "lockout cleared"})
+}
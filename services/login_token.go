@@ -0,0 +1,269 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"encoding/base64"
+	"go-http-svc/models"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+)
+
+// loginTokenOptions reads ?single_use=true&expires_in=hours, tokens are
+// valid 24 hours by default
+func loginTokenOptions(c *gin.Context) (bool, time.Duration) {
+	singleUse, _ := strconv.ParseBool(c.Query("single_use"))
+	hours, err := strconv.Atoi(c.Query("expires_in"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	return singleUse, time.Duration(hours) * time.Hour
+}
+
+// newLoginToken stores a login token for the user and returns its plaintext
+func newLoginToken(c *gin.Context, db *gorm.DB, user models.ExUser, singleUse bool, ttl time.Duration) (string, *models.ExLoginToken, error) {
+	token := RandomToken(24)
+	loginToken := models.ExLoginToken{
+		Eid:       user.Eid,
+		Uid:       user.ID,
+		TokenHash: HashToken(token),
+		SingleUse: singleUse,
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedBy: GetClaims(c).UserId,
+	}
+	if err := db.Create(&loginToken).Error; err != nil {
+		return "", nil, err
+	}
+	return token, &loginToken, nil
+}
+
+// LoginURL is what the QR codes encode: LOGIN_URL_BASE with the token
+// appended as the token query param, or the bare token when not set.
+func LoginURL(token string) string {
+	base := os.Getenv("LOGIN_URL_BASE")
+	if base == "" {
+		return token
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return token
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// CreateLoginToken godoc
+// @Summary Create a login token for an user
+// @Description The token is exchanged for a JWT at /login/token, typically by scanning the QR code.
+// @Description It's returned once, only its hash is stored.
+// @Tags user
+// @Security BearerAuth
+// @Produce json
+// @Produce png
+// @Param eid path int true "models.ExUser EID"
+// @Param id path int true "models.ExUser ID"
+// @Param single_use query bool false "the token works only once"
+// @Param expires_in query int false "validity in hours, default 24"
+// @Param format query string false "png: respond with the QR code image"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/users/{id}/login_tokens [post]
+func CreateLoginToken(c *gin.Context, db *gorm.DB) {
+	var user models.ExUser
+	if result := TenantDB(c, db).First(&user, c.Param("id")); result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	// logging in as an user is as good as holding their role
+	if !CanGrantRole(c, user.EffectiveRole()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "can not log in as an user with role " + user.EffectiveRole()})
+		return
+	}
+
+	singleUse, ttl := loginTokenOptions(c)
+	token, loginToken, err := newLoginToken(c, db, user, singleUse, ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.Query("format") == "png" {
+		png, err := qrcode.Encode(LoginURL(token), qrcode.Medium, 256)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "image/png", png)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":       token,
+		"url":         LoginURL(token),
+		"login_token": loginToken,
+	})
+}
+
+var loginSheet = template.Must(template.New("sheet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+.card { display: inline-block; width: 30%; margin: 8px; padding: 8px; text-align: center; border: 1px dashed #999; page-break-inside: avoid; }
+.card img { width: 100%; }
+</style>
+</head>
+<body>
+<h2>{{.Title}}</h2>
+{{range .Cards}}<div class="card">
+<img src="{{.QR}}">
+<div><b>{{.Name}}</b></div>
+<div>{{.Title}}</div>
+<div>{{.Uname}}</div>
+</div>
+{{end}}</body>
+</html>
+`))
+
+type loginCard struct {
+	Name  string
+	Title string
+	Uname string
+	QR    template.URL
+}
+
+// GetLoginSheet godoc
+// @Summary Printable sheet of QR login codes
+// @Description Creates a login token for every active user of the exhibition, optionally
+// @Description only those with the given role, and renders a printable html page of QR codes.
+// @Tags user
+// @Security BearerAuth
+// @Produce html
+// @Param eid path int true "models.ExUser EID"
+// @Param role query string false "only users with this role"
+// @Param single_use query bool false "the tokens work only once"
+// @Param expires_in query int false "validity in hours, default 24"
+// @Success 200 {string} string "html page"
+// @Router /api/{eid}/login_sheet [post]
+func GetLoginSheet(c *gin.Context, db *gorm.DB) {
+	query := TenantDB(c, db).Where("is_active=?", true).Order("id")
+	if role := c.Query("role"); role != "" {
+		query = query.Where("role=?", role)
+	}
+	var users []models.ExUser
+	if result := query.Find(&users); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+
+	singleUse, ttl := loginTokenOptions(c)
+	var cards []loginCard
+	for _, user := range users {
+		if !CanGrantRole(c, user.EffectiveRole()) {
+			continue
+		}
+		token, _, err := newLoginToken(c, db, user, singleUse, ttl)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		png, err := qrcode.Encode(LoginURL(token), qrcode.Medium, 256)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		cards = append(cards, loginCard{
+			Name:  user.Name,
+			Title: user.Title,
+			Uname: user.Uname,
+			QR:    template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		})
+	}
+
+	var exibition models.Exibition
+	db.First(&exibition, GetEid(c))
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	loginSheet.Execute(c.Writer, gin.H{"Title": exibition.Title, "Cards": cards})
+}
+
+// GetLoginTokens godoc
+// @Summary Get the usable login tokens of an user
+// @Tags user
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.ExUser EID"
+// @Param id path int true "models.ExUser ID"
+// @Success 200 {array} models.ExLoginToken
+// @Router /api/{eid}/users/{id}/login_tokens [get]
+func GetLoginTokens(c *gin.Context, db *gorm.DB) {
+	var tokens []models.ExLoginToken
+	if result := TenantDB(c, db).Where("uid=? and is_active=? and expires_at>? and not (single_use and used_at is not null)",
+		c.Param("id"), true, time.Now()).Order("id desc").Find(&tokens); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// RevokeLoginTokens godoc
+// @Summary Revoke the login tokens of an user
+// @Description Sessions already opened with them are kept, see /api/{eid}/users/{id}/sessions
+// @Tags user
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.ExUser EID"
+// @Param id path int true "models.ExUser ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/users/{id}/login_tokens [delete]
+func RevokeLoginTokens(c *gin.Context, db *gorm.DB) {
+	result := TenantDB(c, db).Model(&models.ExLoginToken{}).Where("uid=? and is_active=?", c.Param("id"), true).Update("is_active", false)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": result.RowsAffected})
+}
+
+// RedeemLoginToken checks a login token and returns its user, single use
+// tokens are consumed with a conditional update so they can't be raced.
+func RedeemLoginToken(db *gorm.DB, token string) (*models.ExUser, error) {
+	var loginToken models.ExLoginToken
+	if err := db.Where("token_hash=?", HashToken(token)).First(&loginToken).Error; err != nil {
+		return nil, err
+	}
+	if !loginToken.IsActive || loginToken.ExpiresAt.Before(time.Now()) {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	now := time.Now()
+	query := db.Model(&loginToken)
+	if loginToken.SingleUse {
+		query = query.Where("used_at is null")
+	}
+	result := query.Update("used_at", &now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if loginToken.SingleUse && result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var user models.ExUser
+	if err := db.First(&user, loginToken.Uid).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,121 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"crypto/rand"
+	"go-http-svc/models"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// DummyCheckPassword takes as long as CheckPassword, so that a login of an
+// unknown user can't be told apart by its response time
+func DummyCheckPassword(password string) {
+	bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+}
+
+// IsPasswordHash tells bcrypt hashes apart from the plaintext passwords
+// stored before hashing was enforced
+func IsPasswordHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// GeneratePassword returns a random password, without look alike characters
+// since it's typed from a printed sheet
+func GeneratePassword(length int) string {
+	const charset = "abcdefghjkmnpqrstuvwxyz23456789"
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			panic(err)
+		}
+		b[i] = charset[n.Int64()]
+	}
+	return string(b)
+}
+
+// setInitialPassword hashes the given password, or a generated one when
+// empty, and makes the user change it on first login. A generated
+// plaintext is kept in InitialPassword to be returned once.
+func setInitialPassword(user *models.ExUser, password string) error {
+	if password == "" {
+		password = GeneratePassword(8)
+		user.InitialPassword = password
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+	user.MustChangePassword = true
+	return nil
+}
+
+// MigratePlaintextPasswords hashes the passwords stored in plaintext
+// and forces those users to pick a new one.
+func MigratePlaintextPasswords(db *gorm.DB) error {
+	var users []models.ExUser
+	return db.Where("password not like ?", "$2%").FindInBatches(&users, 100, func(tx *gorm.DB, batch int) error {
+		for i := range users {
+			hash, err := HashPassword(users[i].Password)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&users[i]).Updates(map[string]interface{}{
+				"password":             hash,
+				"must_change_password": true,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+// respondCredentials sends the initial credentials of new users, as json
+// or as a printable xlsx sheet with ?export=xlsx
+func respondCredentials(c *gin.Context, users []models.ExUser) {
+	if c.Query("export") != "xlsx" {
+		c.JSON(http.StatusOK, users)
+		return
+	}
+
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	f.SetSheetRow(sheet, "A1", &[]interface{}{"id", "name", "title", "uname", "password"})
+	for i, user := range users {
+		f.SetSheetRow(sheet, "A"+strconv.Itoa(i+2), &[]interface{}{user.ID, user.Name, user.Title, user.Uname, user.InitialPassword})
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="credentials.xlsx"`)
+	c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	if err := f.Write(c.Writer); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,62 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"go-http-svc/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetClaims returns the claims set by AuthMiddleware
+func GetClaims(c *gin.Context) *models.Claims {
+	claims, ok := c.Get("user")
+	if !ok || claims == nil {
+		return nil
+	}
+	claim, _ := claims.(*models.Claims)
+	return claim
+}
+
+func HasPerm(c *gin.Context, perm string) bool {
+	claims := GetClaims(c)
+	return claims != nil && claims.HasPerm(perm)
+}
+
+// IsGlobal tells users not bound to an exhibition (eid 0) apart from
+// exhibition scoped ones
+func IsGlobal(c *gin.Context) bool {
+	claims := GetClaims(c)
+	return claims != nil && claims.Eid == 0
+}
+
+// CanGrantRole prevents privilege escalation: an user may only hand out
+// roles whose permissions they hold themselves.
+func CanGrantRole(c *gin.Context, role string) bool {
+	claims := GetClaims(c)
+	if claims == nil {
+		return false
+	}
+	for _, perm := range models.RolePerms[role] {
+		if !claims.HasPerm(perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// RequirePerm is the route level guard, aborts unless the token grants perm.
+// On /:eid routes ExibitionScope has already limited exhibition bound
+// users to their own exhibition.
+func RequirePerm(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasPerm(c, perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "permission denied: " + perm})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
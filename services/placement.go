@@ -0,0 +1,225 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"go-http-svc/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The models.CatalogPolicy of an exhibition is checked wherever catalogs
+// and items are created or moved: CreateExCatalog, moveCatalog,
+// CreateExItem, UpdateExItem, the reparent delete and the imports.
+
+var errPlacement = errors.New("against the catalog policy")
+
+func getCatalogPolicy(db *gorm.DB, eid int) models.CatalogPolicy {
+	var exibition models.Exibition
+	db.Select("id, item_placement, max_catalog_depth").First(&exibition, eid)
+	return exibition.CatalogPolicy
+}
+
+// catalogDepth returns the level of catalog id, 1 for the top level and 0
+// for none
+func catalogDepth(db *gorm.DB, eid int, id int) int {
+	if id == 0 {
+		return 0
+	}
+	parents, _ := GetParentsUsingCTE(db, strconv.Itoa(id), eid)
+	return len(parents)
+}
+
+// subtreeHeight returns the levels of the subtree of catalog id, 1 for a
+// catalog without children
+func subtreeHeight(db *gorm.DB, id int) (int, error) {
+	var height int
+	err := db.Raw(`
+		WITH RECURSIVE child_tree AS (
+			SELECT id, 1 AS depth FROM ex_catalogs WHERE id = ? and is_deleted = false
+			UNION ALL
+			SELECT n.id, ct.depth + 1 FROM ex_catalogs n
+			INNER JOIN child_tree ct ON n.pid = ct.id
+			WHERE n.is_deleted = false
+		)
+		SELECT COALESCE(MAX(depth), 1) FROM child_tree;
+	`, id).Scan(&height).Error
+	return height, err
+}
+
+// checkItemPlacement tells whether items may go in catalog cid, 0 for none
+func checkItemPlacement(db *gorm.DB, policy models.CatalogPolicy, cid int) error {
+	if cid != 0 && policy.LeafOnly() && !IsLeafCatalog(db, cid) {
+		return fmt.Errorf("%w: items only go in catalogs without child catalogs", errPlacement)
+	}
+	return nil
+}
+
+// checkCatalogPlacement tells whether a subtree height levels deep may go
+// under catalog pid, 0 for the top level
+func checkCatalogPlacement(db *gorm.DB, policy models.CatalogPolicy, eid int, pid int, height int) error {
+	if pid != 0 && policy.LeafOnly() && IsCatalogHasItem(db, pid) {
+		return fmt.Errorf("%w: the catalog has items, it can't have child catalogs", errPlacement)
+	}
+	if policy.MaxCatalogDepth > 0 && catalogDepth(db, eid, pid)+height > policy.MaxCatalogDepth {
+		return fmt.Errorf("%w: catalogs go %d levels deep at most", errPlacement, policy.MaxCatalogDepth)
+	}
+	return nil
+}
+
+// checkMovedPlacement tells whether the child catalogs and the items of
+// catalog may move to catalog target when it's deleted with policy reparent
+func checkMovedPlacement(tx *gorm.DB, catalog *models.ExCatalog, target int, children []int, items []int) error {
+	policy := getCatalogPolicy(tx, catalog.Eid)
+	if policy.LeafOnly() && len(children) > 0 && len(items) > 0 {
+		return fmt.Errorf("%w: the target catalog would hold both catalogs and items", errPlacement)
+	}
+	height := 0
+	for _, id := range children {
+		h, err := subtreeHeight(tx, id)
+		if err != nil {
+			return err
+		}
+		if h > height {
+			height = h
+		}
+	}
+	if height > 0 {
+		if err := checkCatalogPlacement(tx.Where("eid=?", catalog.Eid), policy, catalog.Eid, target, height); err != nil {
+			return err
+		}
+	}
+	if len(items) > 0 {
+		// the catalog deleted doesn't count as a child of the target
+		return checkItemPlacement(tx.Where("id<>?", catalog.ID), policy, target)
+	}
+	return nil
+}
+
+// SetCatalogPolicy godoc
+// @Summary Set where the catalogs and the items of an exibition may go
+// @Description item_placement leaf keeps items in catalogs without child catalogs, any lets them go
+// @Description anywhere. max_catalog_depth limits the levels of catalogs, 0 for no limit. What's
+// @Description already there isn't changed, see GetPlacementViolations.
+// @Tags exibition
+// @Security BearerAuth
+// @Accept  json
+// @Produce json
+// @Param id path int true "Exibition ID"
+// @Param policy body models.CatalogPolicy true "Catalog policy"
+// @Success 200 {object} models.Exibition
+// @Router /api/exibitions/{id}/catalog_policy [put]
+func SetCatalogPolicy(c *gin.Context, db *gorm.DB) {
+	var input models.CatalogPolicy
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.ItemPlacement != models.ItemsInLeaves && input.ItemPlacement != models.ItemsAnywhere {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "item_placement is leaf or any"})
+		return
+	}
+	if input.MaxCatalogDepth < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_catalog_depth can't be negative"})
+		return
+	}
+	var exibition models.Exibition
+	if result := db.First(&exibition, c.Param("id")); result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "exibition not found"})
+		return
+	}
+	if err := db.Model(&exibition).Select("item_placement", "max_catalog_depth").Updates(&models.Exibition{CatalogPolicy: input}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, exibition)
+}
+
+// Problems of a PlacementViolation
+const (
+	// items in a catalog with child catalogs, when items only go in leaves
+	ViolationItemsInBranch = "items_in_branch"
+	// catalog deeper than max_catalog_depth
+	ViolationTooDeep = "too_deep"
+	// items in a catalog that is deleted or doesn't exist
+	ViolationNoCatalog = "no_catalog"
+)
+
+// PlacementViolation is a catalog against the catalog policy
+type PlacementViolation struct {
+	Cid      int    `json:"cid"`
+	Name     string `json:"name"`
+	Problem  string `json:"problem"`
+	Depth    int    `json:"depth"`
+	Items    int    `json:"items"`
+	Children int    `json:"children"`
+}
+
+// GetPlacementViolations godoc
+// @Summary List the catalogs against the catalog policy
+// @Description Catalogs with both items and child catalogs when items only go in leaves, catalogs deeper
+// @Description than max_catalog_depth, and items in catalogs that are deleted or don't exist.
+// @Tags catalog
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/catalogs/violations [get]
+func GetPlacementViolations(c *gin.Context, db *gorm.DB) {
+	eid := GetEid(c)
+	policy := getCatalogPolicy(db, eid)
+
+	var catalogs []models.ExCatalog
+	if result := TenantDB(c, db).Order("sort, id").Find(&catalogs); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	figures, err := catalogFigures(db, eid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	pids := make(map[int]int, len(catalogs))
+	children := map[int]int{}
+	for _, catalog := range catalogs {
+		pids[catalog.ID] = catalog.Pid
+		children[catalog.Pid]++
+	}
+	violations := []PlacementViolation{}
+	for _, catalog := range catalogs {
+		// a cycle or a deleted parent stops the walk up
+		depth := 1
+		for id := catalog.Pid; id != 0 && depth <= len(catalogs); id = pids[id] {
+			if _, ok := pids[id]; !ok {
+				break
+			}
+			depth++
+		}
+		violation := PlacementViolation{
+			Cid: catalog.ID, Name: catalog.Name, Depth: depth,
+			Items: figures[catalog.ID].Items, Children: children[catalog.ID],
+		}
+		if policy.LeafOnly() && violation.Items > 0 && violation.Children > 0 {
+			violation.Problem = ViolationItemsInBranch
+			violations = append(violations, violation)
+		}
+		if policy.MaxCatalogDepth > 0 && depth > policy.MaxCatalogDepth {
+			violation.Problem = ViolationTooDeep
+			violations = append(violations, violation)
+		}
+	}
+	for cid, f := range figures {
+		if _, ok := pids[cid]; !ok && cid != 0 {
+			violations = append(violations, PlacementViolation{Cid: cid, Problem: ViolationNoCatalog, Items: f.Items})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"policy": policy, "violations": violations})
+}
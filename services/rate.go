@@ -6,7 +6,6 @@ package services
 import (
 	"go-http-svc/models"
 	"net/http"
-	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -23,13 +22,8 @@ import (
 // @Success 200 {object} models.ExRate
 // @Router /api/{eid}/rates [put]
 func CreateExRate(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatched eid"})
-		return
-	}
+	eid := GetEid(c)
+	claims := GetClaims(c)
 
 	var input models.ExRateInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -40,8 +34,14 @@ func CreateExRate(c *gin.Context, db *gorm.DB) {
 	input.Uid = claims.UserId
 	input.Eid = eid
 
+	tdb := TenantDB(c, db)
+	if !IsItemExists(tdb, input.Iid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "item not found"})
+		return
+	}
+
 	var rate models.ExRate
-	if result := db.Where("uid=? and iid=? and eid=?", input.Uid, input.Iid, input.Eid).First(&rate); result.Error != nil {
+	if result := tdb.Where("uid=? and iid=?", input.Uid, input.Iid).First(&rate); result.Error != nil {
 		rate = models.ExRate{
 			ExRateInput: input,
 		}
@@ -69,7 +69,7 @@ func CreateExRate(c *gin.Context, db *gorm.DB) {
 func GetExRate(c *gin.Context, db *gorm.DB) {
 	id := c.Param("id")
 	var rate models.ExRate
-	if result := db.First(&rate, id); result.Error != nil {
+	if result := TenantDB(c, db).First(&rate, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "rate not found"})
 		return
 	}
@@ -86,17 +86,11 @@ func GetExRate(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExRate
 // @Router /api/{eid}/rate_item/{id} [get]
 func GetMyRateByItemID(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
+	claims := GetClaims(c)
 
 	id := c.Param("id")
 	var rate models.ExRate
-	if result := db.Where("iid=? and uid=?", id, claims.UserId).First(&rate); result.Error != nil {
+	if result := TenantDB(c, db).Where("iid=? and uid=?", id, claims.UserId).First(&rate); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "rate not found"})
 		return
 	}
@@ -113,13 +107,7 @@ func GetMyRateByItemID(c *gin.Context, db *gorm.DB) {
 // @Success 200 {array} models.ExRate
 // @Router /api/{eid}/my_rates_items [post]
 func GetMyRatesByItemIDs(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
+	claims := GetClaims(c)
 
 	var input []int
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -132,7 +120,7 @@ func GetMyRatesByItemIDs(c *gin.Context, db *gorm.DB) {
 	}
 
 	var rates []models.ExRate
-	if result := db.Where("eid=? and iid in ? and uid=? ", eid, input, claims.UserId).Find(&rates); result.Error != nil {
+	if result := TenantDB(c, db).Where("iid in ? and uid=? ", input, claims.UserId).Find(&rates); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "rate not found"})
 		return
 	}
@@ -149,17 +137,9 @@ func GetMyRatesByItemIDs(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExRate
 // @Router /api/{eid}/rates_item/{id} [get]
 func GetTotalRatesByItemID(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
-
 	id := c.Param("id")
 	var rates []models.ExRate
-	if result := db.Where("iid=?", id).Find(&rates); result.Error != nil {
+	if result := TenantDB(c, db).Where("iid=?", id).Find(&rates); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "rate not found"})
 		return
 	}
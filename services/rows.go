@@ -0,0 +1,68 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+var errUnknownSheet = errors.New("not a .xlsx or .csv file")
+
+// ReadRows returns the rows of a spreadsheet: the sheet named sheet of an
+// xlsx file, the first one when sheet is empty, or a CSV file, told apart
+// by the extension of name.
+func ReadRows(r io.Reader, name string, sheet string) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".xlsx":
+		f, err := excelize.OpenReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if sheet == "" {
+			sheet = f.GetSheetName(0)
+		}
+		return f.GetRows(sheet)
+	case ".csv":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		// spreadsheet programs start their CSV exports with a BOM
+		reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+		reader.FieldsPerRecord = -1
+		return reader.ReadAll()
+	default:
+		return nil, errUnknownSheet
+	}
+}
+
+// cell returns column i of row, rows of spreadsheets leave out the empty
+// cells at their end
+func cell(row []string, i int) string {
+	if i < 0 || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// headerIndex maps the column headers of row to their index, lower cased
+// with spaces as underscores, "Name EN" is name_en
+func headerIndex(row []string) map[string]int {
+	index := make(map[string]int, len(row))
+	for i := range row {
+		key := strings.ToLower(strings.Join(strings.Fields(cell(row, i)), "_"))
+		if _, ok := index[key]; key != "" && !ok {
+			index[key] = i
+		}
+	}
+	return index
+}
@@ -0,0 +1,54 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"errors"
+	"go-http-svc/models"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// StartScheduler runs the exhibition schedule every interval, in the
+// background: published exhibitions open at their StartTime, becoming the
+// current one, and open exhibitions close at their EndTime unless they were
+// reopened by hand after it.
+// Transitions are conditional, so several instances may run it.
+func StartScheduler(db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			RunSchedule(db, time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+func RunSchedule(db *gorm.DB, now time.Time) {
+	var opening []models.Exibition
+	db.Where("status=? and start_time is not null and start_time<=? and (end_time is null or end_time>?)",
+		models.ExibitionPublished, now, now).Order("start_time").Find(&opening)
+	for i := range opening {
+		scheduleTransition(db, &opening[i], models.ExibitionOpen, "start_time reached")
+	}
+
+	var closing []models.Exibition
+	db.Where("status=? and end_time is not null and end_time<=?", models.ExibitionOpen, now).
+		Where("not exists (select 1 from exibition_transitions t where t.eid=exibitions.id and t.kind=? and t.`to`=? and t.create_time>=exibitions.end_time)",
+			models.TransitionStatus, models.ExibitionOpen).Find(&closing)
+	for i := range closing {
+		scheduleTransition(db, &closing[i], models.ExibitionClosed, "end_time reached")
+	}
+}
+
+func scheduleTransition(db *gorm.DB, exibition *models.Exibition, to, reason string) {
+	err := TransitionExibition(db, exibition, to, 0, reason)
+	// another instance got there first
+	if err != nil && !errors.Is(err, ErrInvalidTransition) {
+		log.Printf("scheduler: exibition %d to %s: %v", exibition.ID, to, err)
+	}
+}
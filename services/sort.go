@@ -0,0 +1,163 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"go-http-svc/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Catalogs are listed by Sort among the catalogs of the same parent, items
+// among the items of the same catalog. New ones go last.
+
+var errInvalidOrder = errors.New("invalid order")
+
+// nextSort returns the Sort placing a new record of model last under
+// parent, column is pid for catalogs and cid for items
+func nextSort(tx *gorm.DB, model interface{}, column string, parent int) int {
+	var last int
+	tx.Model(model).Where(column+"=?", parent).Select("COALESCE(MAX(sort), 0)").Scan(&last)
+	return last + 1
+}
+
+// reorder sets the Sort of the records of model under parent to the order
+// of ids, the records left out follow in their current order
+func reorder(tx *gorm.DB, model interface{}, column string, parent int, ids []int) error {
+	var siblings []struct{ ID, Sort int }
+	if err := tx.Model(model).Select("id, sort").Where(column+"=?", parent).Order("sort, id").Scan(&siblings).Error; err != nil {
+		return err
+	}
+	sorts := make(map[int]int, len(siblings))
+	for _, sibling := range siblings {
+		sorts[sibling.ID] = sibling.Sort
+	}
+	order := make([]int, 0, len(siblings))
+	listed := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if _, ok := sorts[id]; !ok {
+			return fmt.Errorf("%w: %d is not under %d", errInvalidOrder, id, parent)
+		}
+		if listed[id] {
+			return fmt.Errorf("%w: %d is listed twice", errInvalidOrder, id)
+		}
+		listed[id] = true
+		order = append(order, id)
+	}
+	for _, sibling := range siblings {
+		if !listed[sibling.ID] {
+			order = append(order, sibling.ID)
+		}
+	}
+
+	for i, id := range order {
+		if sorts[id] == i+1 {
+			continue
+		}
+		if err := tx.Model(model).Where("id=?", id).UpdateColumn("sort", i+1).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillSorts numbers the catalogs and the items stored before Sort
+// existed, all at 0 under their parent, in the order they were listed:
+// catalogs newest first, items by id descending. It returns how many
+// parents were numbered.
+func BackfillSorts(db *gorm.DB) (int, error) {
+	catalogs, err := backfillSorts(db, &models.ExCatalog{}, "pid", "create_time desc, id desc")
+	if err != nil {
+		return catalogs, err
+	}
+	items, err := backfillSorts(db, &models.ExItem{}, "cid", "id desc")
+	return catalogs + items, err
+}
+
+func backfillSorts(db *gorm.DB, model interface{}, column string, order string) (int, error) {
+	var parents []struct{ Eid, Parent int }
+	if err := db.Unscoped().Model(model).Select("eid, "+column+" AS parent").
+		Group("eid, " + column).Having("COALESCE(MAX(sort), 0) = 0").Scan(&parents).Error; err != nil {
+		return 0, err
+	}
+	for n, parent := range parents {
+		var ids []int
+		if err := db.Unscoped().Model(model).Where("eid=? and "+column+"=?", parent.Eid, parent.Parent).
+			Order(order).Pluck("id", &ids).Error; err != nil {
+			return n, err
+		}
+		for i, id := range ids {
+			if err := db.Unscoped().Model(model).Where("id=?", id).UpdateColumn("sort", i+1).Error; err != nil {
+				return n, err
+			}
+		}
+	}
+	return len(parents), nil
+}
+
+// runReorder binds the ordered ids and reorders the records of model under
+// the parent given by the body field named after column
+func runReorder(c *gin.Context, db *gorm.DB, model interface{}, column string) {
+	var input struct {
+		Pid int   `json:"pid"`
+		Cid int   `json:"cid"`
+		Ids []int `json:"ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	parent := input.Pid
+	if column == "cid" {
+		parent = input.Cid
+	}
+	err := TenantDB(c, db).Transaction(func(tx *gorm.DB) error {
+		return reorder(tx, model, column, parent, input.Ids)
+	})
+	if errors.Is(err, errInvalidOrder) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "reordered successfully"})
+}
+
+// ReorderExCatalogs godoc
+// @Summary Reorder the catalogs under a parent
+// @Description ids lists the child catalogs of pid (0 for the top level) in their new order, those
+// @Description left out follow in their current order.
+// @Tags catalog
+// @Security BearerAuth
+// @Accept  json
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param order body map[string]interface{} true "{pid, ids}"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/catalogs/reorder [post]
+func ReorderExCatalogs(c *gin.Context, db *gorm.DB) {
+	runReorder(c, db, &models.ExCatalog{}, "pid")
+}
+
+// ReorderExItems godoc
+// @Summary Reorder the items of a catalog
+// @Description ids lists the items of the catalog cid in their new order, those left out follow
+// @Description in their current order.
+// @Tags item
+// @Security BearerAuth
+// @Accept  json
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param order body map[string]interface{} true "{cid, ids}"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/items/reorder [post]
+func ReorderExItems(c *gin.Context, db *gorm.DB) {
+	runReorder(c, db, &models.ExItem{}, "cid")
+}
@@ -22,16 +22,8 @@ import (
 // @Success 200  {object} map[string]int
 // @Router /api/{eid}/stats/num_users_total [get]
 func GetTotoalUsers(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
-
 	var sum int64
-	if result := db.Model(&models.ExUser{}).Where("eid = ?", eid).Count(&sum); result.Error != nil {
+	if result := TenantDB(c, db).Model(&models.ExUser{}).Count(&sum); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
 		return
 	}
@@ -48,17 +40,10 @@ func GetTotoalUsers(c *gin.Context, db *gorm.DB) {
 // @Success 200  {object} map[string]int
 // @Router /api/{eid}/stats/num_amount_total [get]
 func GetTotalAmount(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
 	var sum struct {
 		Sum int
 	}
-	if result := db.Model(&models.ExAmount{}).Select("sum(amount) as sum").Where("eid=?", eid).Scan(&sum); result.Error != nil {
+	if result := TenantDB(c, db).Model(&models.ExAmount{}).Select("sum(amount) as sum").Scan(&sum); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "amount not found"})
 		return
 	}
@@ -75,15 +60,8 @@ func GetTotalAmount(c *gin.Context, db *gorm.DB) {
 // @Success 200  {object} map[string]int
 // @Router /api/{eid}/stats/num_items_total [get]
 func GetTotalItems(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
 	var sum int64
-	if result := db.Model(&models.ExItem{}).Where("eid = ?", eid).Count(&sum); result.Error != nil {
+	if result := TenantDB(c, db).Model(&models.ExItem{}).Count(&sum); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
 		return
 	}
@@ -101,20 +79,14 @@ func GetTotalItems(c *gin.Context, db *gorm.DB) {
 // @Success 200  {object} map[string]int
 // @Router /api/{eid}/stats/excellent_items/{rate} [get]
 func GetExcellentItems(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
+	eid := GetEid(c)
 	rate, _ := strconv.ParseFloat(c.Param("rate"), 64)
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
 
 	var results []struct {
 		Iid     int     `json:"iid"`
 		AvgRate float64 `json:"avg_rate"`
 	}
-	if result := db.Table("ex_rates").Select("ex_rates.iid, AVG(ex_rates.rate) as avg_rate").Where("eid = ?", eid).Having("avg_rate >= ?", rate).Order("avg_rate desc").Group("iid").Scan(&results); result.Error != nil {
+	if result := db.Table("ex_rates").Select("ex_rates.iid, AVG(ex_rates.rate) as avg_rate").Where("eid = ? and is_deleted = false", eid).Having("avg_rate >= ?", rate).Order("avg_rate desc").Group("iid").Scan(&results); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
 		return
 	}
@@ -134,14 +106,8 @@ func GetExcellentItems(c *gin.Context, db *gorm.DB) {
 // @Success 200  {array} map[string]interface{}
 // @Router /api/{eid}/stats/topn_amount_items/{topN} [get]
 func GetTopNAmountItems(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
+	eid := GetEid(c)
 	topN, _ := strconv.Atoi(c.Param("topN"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
 
 	var results []struct {
 		ID        int
@@ -155,10 +121,10 @@ func GetTopNAmountItems(c *gin.Context, db *gorm.DB) {
 
 	query := db.Table("ex_items").
 		Select("ex_items.id, ex_items.name, ex_items.images, ex_items.cid, ex_catalogs.name as cname, COALESCE(rates.avg_rate, 0) as avg_rate, COALESCE(amounts.total_amount, 0) as sum_amount").
-		Joins("LEFT JOIN ex_catalogs ON ex_items.cid = ex_catalogs.id and ex_catalogs.eid=ex_items.eid").
-		Joins("LEFT JOIN (SELECT iid, AVG(rate) as avg_rate FROM ex_rates WHERE eid = ? GROUP BY iid) as rates ON rates.iid = ex_items.id", eid).
-		Joins("LEFT JOIN (SELECT iid, SUM(amount) as total_amount FROM ex_amounts WHERE eid = ? GROUP BY iid) as amounts ON amounts.iid = ex_items.id", eid).
-		Where("ex_items.eid = ?", eid).
+		Joins("LEFT JOIN ex_catalogs ON ex_items.cid = ex_catalogs.id and ex_catalogs.eid=ex_items.eid and ex_catalogs.is_deleted = false").
+		Joins("LEFT JOIN (SELECT iid, AVG(rate) as avg_rate FROM ex_rates WHERE eid = ? and is_deleted = false GROUP BY iid) as rates ON rates.iid = ex_items.id", eid).
+		Joins("LEFT JOIN (SELECT iid, SUM(amount) as total_amount FROM ex_amounts WHERE eid = ? and is_deleted = false GROUP BY iid) as amounts ON amounts.iid = ex_items.id", eid).
+		Where("ex_items.eid = ? and ex_items.is_deleted = false", eid).
 		Order("sum_amount desc")
 
 	if result := query.Limit(topN).Scan(&results); result.Error != nil {
@@ -179,14 +145,8 @@ func GetTopNAmountItems(c *gin.Context, db *gorm.DB) {
 // @Success 200  {array} map[string]interface{}
 // @Router /api/{eid}/stats/topn_orders_items/{topN} [get]
 func GetTopNOrdersItems(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
+	eid := GetEid(c)
 	topN, _ := strconv.Atoi(c.Param("topN"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
 
 	var results []struct {
 		ID     int
@@ -200,7 +160,7 @@ func GetTopNOrdersItems(c *gin.Context, db *gorm.DB) {
 	// 	c.JSON(http.StatusNotFound, gin.H{"error": "amount not found"})
 	// 	return
 	// }
-	if result := db.Table("ex_users").Select("ex_users.id, ex_users.name, ex_users.title, SUM(ex_amounts.amount) as sum, COUNT(ex_amounts.id) as orders").Joins("left join ex_amounts on ex_amounts.uid=ex_users.id").Group("ex_users.id").Where("ex_users.eid=?", eid).Order("sum desc").Limit(topN).Scan(&results); result.Error != nil {
+	if result := db.Table("ex_users").Select("ex_users.id, ex_users.name, ex_users.title, SUM(ex_amounts.amount) as sum, COUNT(ex_amounts.id) as orders").Joins("left join ex_amounts on ex_amounts.uid=ex_users.id and ex_amounts.is_deleted = false").Group("ex_users.id").Where("ex_users.eid=? and ex_users.is_deleted = false", eid).Order("sum desc").Limit(topN).Scan(&results); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "amount not found"})
 		return
 	}
@@ -218,14 +178,8 @@ func GetTopNOrdersItems(c *gin.Context, db *gorm.DB) {
 // @Success 200  {array} map[string]interface{}
 // @Router /api/{eid}/stats/topn_rate_items/{topN} [get]
 func GetTopNRateItems(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
+	eid := GetEid(c)
 	topN, _ := strconv.Atoi(c.Param("topN"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
 
 	var results []struct {
 		Iid    int
@@ -234,7 +188,7 @@ func GetTopNRateItems(c *gin.Context, db *gorm.DB) {
 		Sum    float64
 	}
 
-	if result := db.Table("ex_rates").Select("ex_rates.iid, ex_items.name, ex_items.thumbnails as images ,SUM(rate) as sum").Joins("left join ex_items on ex_items.id=ex_rates.iid").Group("ex_rates.iid").Where("ex_rates.eid=?", eid).Order("sum desc").Limit(topN).Scan(&results); result.Error != nil {
+	if result := db.Table("ex_rates").Select("ex_rates.iid, ex_items.name, ex_items.thumbnails as images ,SUM(rate) as sum").Joins("left join ex_items on ex_items.id=ex_rates.iid").Group("ex_rates.iid").Where("ex_rates.eid=? and ex_rates.is_deleted = false", eid).Order("sum desc").Limit(topN).Scan(&results); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "rate not found"})
 		return
 	}
@@ -251,13 +205,7 @@ func GetTopNRateItems(c *gin.Context, db *gorm.DB) {
 // @Success 200  {array} map[string]interface{}
 // @Router /api/{eid}/stats/catalog_trending [get]
 func GetCatalogTrending(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
+	eid := GetEid(c)
 
 	type CatalogSummary struct {
 		Cid         int
@@ -272,10 +220,10 @@ func GetCatalogTrending(c *gin.Context, db *gorm.DB) {
 		Select("ex_items.cid, ex_catalogs.name, "+
 			"COALESCE(SUM(DISTINCT ex_amounts.amount), 0) as total_orders, "+
 			"COALESCE(SUM(DISTINCT ex_rates.rate), 0) as total_scores").
-		Where("ex_items.eid = ?", eid).
-		Joins("LEFT JOIN ex_amounts ON ex_amounts.iid = ex_items.id and ex_amounts.eid = ex_items.eid").
-		Joins("LEFT JOIN ex_rates ON ex_rates.iid = ex_items.id and ex_rates.eid = ex_items.eid").
-		Joins("inner JOIN ex_catalogs ON ex_catalogs.id = ex_items.cid").
+		Where("ex_items.eid = ? and ex_items.is_deleted = false", eid).
+		Joins("LEFT JOIN ex_amounts ON ex_amounts.iid = ex_items.id and ex_amounts.eid = ex_items.eid and ex_amounts.is_deleted = false").
+		Joins("LEFT JOIN ex_rates ON ex_rates.iid = ex_items.id and ex_rates.eid = ex_items.eid and ex_rates.is_deleted = false").
+		Joins("inner JOIN ex_catalogs ON ex_catalogs.id = ex_items.cid and ex_catalogs.is_deleted = false").
 		Group("ex_items.cid, ex_catalogs.name").Debug().
 		Scan(&result)
 
@@ -291,16 +239,10 @@ func GetCatalogTrending(c *gin.Context, db *gorm.DB) {
 // @Success 200  {array} models.RatingDistribution
 // @Router /api/{eid}/stats/items_rate_distribution [get]
 func GetItemsRateDistribution(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
+	eid := GetEid(c)
 
 	var totalItems int64
-	db.Model(&models.ExItem{}).Count(&totalItems)
+	TenantDB(c, db).Model(&models.ExItem{}).Count(&totalItems)
 	if totalItems == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "no items found"})
 		return
@@ -321,10 +263,11 @@ func GetItemsRateDistribution(c *gin.Context, db *gorm.DB) {
 		FROM (
 			SELECT iid, AVG(rate) AS avg_score
 			FROM ex_rates
+			WHERE eid = ? and is_deleted = false
 			GROUP BY iid
 		) AS avg_scores
 		GROUP BY category
-	`).Scan(&results)
+	`, eid).Scan(&results)
 	for i := range results {
 		results[i].Percent = float64(results[i].Count) / float64(totalItems) * 100
 	}
@@ -341,19 +284,11 @@ func GetItemsRateDistribution(c *gin.Context, db *gorm.DB) {
 // @Success 200  {object} map[string]interface{}
 // @Router /api/{eid}/stats/orders_users_rate [get]
 func GetOrdersRateOfUsers(c *gin.Context, db *gorm.DB) {
-	user, _ := c.Get("user")
-	eid, _ := strconv.Atoi(c.Param("eid"))
-	claims, _ := user.(*models.Claims)
-	if claims.Eid != 0 && claims.Eid != eid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "mismatch eid"})
-		return
-	}
-
 	var rate float64
 	var orders int64
 	var users int64
-	db.Model(&models.ExAmount{}).Where("eid=?", eid).Count(&orders)
-	db.Model(&models.ExUser{}).Where("eid=?", eid).Count(&users)
+	TenantDB(c, db).Model(&models.ExAmount{}).Count(&orders)
+	TenantDB(c, db).Model(&models.ExUser{}).Count(&users)
 	if users == 0 {
 		c.JSON(http.StatusNotFound, map[string]float64{"rate": 0.0})
 		return
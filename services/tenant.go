@@ -0,0 +1,68 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"go-http-svc/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ExibitionScope guards the /:eid route group: the eid is parsed and
+// validated once, users bound to another exhibition are rejected and
+// the eid is put into the context for GetEid/TenantDB.
+// eid 0 addresses the global users and is reserved to global users.
+func ExibitionScope(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		eid, err := strconv.Atoi(c.Param("eid"))
+		if err != nil || eid < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
+			c.Abort()
+			return
+		}
+
+		claims := GetClaims(c)
+		if claims == nil || (claims.Eid != 0 && claims.Eid != eid) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "mismatched eid"})
+			c.Abort()
+			return
+		}
+
+		if eid != 0 {
+			var count int64
+			db.Model(&models.Exibition{}).Where("id=?", eid).Count(&count)
+			if count == 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": "exibition not found"})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Set("eid", eid)
+		c.Next()
+	}
+}
+
+// GetEid returns the eid validated by ExibitionScope
+func GetEid(c *gin.Context) int {
+	return c.GetInt("eid")
+}
+
+// EidScope constrains the query to the exhibition of the request,
+// on the table of the statement so it's safe with joins.
+func EidScope(c *gin.Context) func(*gorm.DB) *gorm.DB {
+	eid := GetEid(c)
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: "eid"}, Value: eid})
+	}
+}
+
+// TenantDB is db with EidScope applied to every query run on it
+func TenantDB(c *gin.Context, db *gorm.DB) *gorm.DB {
+	return db.Scopes(EidScope(c)).Session(&gorm.Session{})
+}
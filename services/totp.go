@@ -0,0 +1,284 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"go-http-svc/models"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+)
+
+// RFC 6238 time based one time passwords, with the parameters every
+// authenticator app supports: SHA1, 6 digits, 30 seconds.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// codes of the previous and the next period are accepted for clock drift
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func GenerateTotpSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode is the HOTP value (RFC 4226) of the counter
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// ValidateTotp checks code against the secret and returns the counter it
+// matched, to be stored and refused next time so that a code can't be replayed.
+func ValidateTotp(secret, code string, lastCounter int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for counter := now - totpSkew; counter <= now+totpSkew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		expected, err := totpCode(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// TotpURL is the otpauth:// uri understood by authenticator apps
+func TotpURL(secret, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", "Exibition")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape("Exibition:"+account) + "?" + v.Encode()
+}
+
+// VerifySecondFactor checks a TOTP code or, failing that, a recovery code
+// of the user and records its use.
+func VerifySecondFactor(db *gorm.DB, user *models.ExUser, code string) bool {
+	if counter, ok := ValidateTotp(user.TotpSecret, code, user.TotpCounter); ok {
+		// conditional so that concurrent requests can't both use the code
+		result := db.Model(user).Where("totp_counter<?", counter).Update("totp_counter", counter)
+		return result.Error == nil && result.RowsAffected == 1
+	}
+
+	hash := HashToken(strings.ToLower(strings.TrimSpace(code)))
+	codes := strings.Split(user.RecoveryCodes, ",")
+	i := slices.Index(codes, hash)
+	if user.RecoveryCodes == "" || i < 0 {
+		return false
+	}
+	remaining := strings.Join(slices.Delete(codes, i, i+1), ",")
+	result := db.Model(user).Where("recovery_codes=?", user.RecoveryCodes).Update("recovery_codes", remaining)
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+func currentUser(c *gin.Context, db *gorm.DB) (*models.ExUser, bool) {
+	var user models.ExUser
+	if err := db.First(&user, GetClaims(c).UserId).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return nil, false
+	}
+	return &user, true
+}
+
+// EnrollTotp godoc
+// @Summary Start the TOTP enrollment of the current user
+// @Description Returns a new secret, as text, otpauth uri and QR code. It's only enabled once
+// @Description a code is confirmed with /api/totp/verify. Reserved to admin roles.
+// @Tags auth
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /api/totp/enroll [post]
+func EnrollTotp(c *gin.Context, db *gorm.DB) {
+	if !HasPerm(c, models.PermUserManage) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "totp is available to admins only"})
+		return
+	}
+	user, ok := currentUser(c, db)
+	if !ok {
+		return
+	}
+	if user.TotpEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "totp already enabled"})
+		return
+	}
+
+	secret := GenerateTotpSecret()
+	if err := db.Model(user).Updates(map[string]interface{}{"totp_secret": secret, "totp_counter": 0}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	uri := TotpURL(secret, user.Uname)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    uri,
+		"qr":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// VerifyTotp godoc
+// @Summary Confirm the TOTP enrollment with a first code
+// @Description Enables TOTP and returns the recovery codes, each usable once in place of a code.
+// @Description They are only shown this time.
+// @Tags auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param code body models.TotpInput true "Code of the authenticator app"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/totp/verify [post]
+func VerifyTotp(c *gin.Context, db *gorm.DB) {
+	var input models.TotpInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := currentUser(c, db)
+	if !ok {
+		return
+	}
+	if user.TotpEnabled || user.TotpSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no totp enrollment pending"})
+		return
+	}
+	counter, ok := ValidateTotp(user.TotpSecret, input.Code, 0)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+		return
+	}
+
+	var codes, hashes []string
+	for i := 0; i < 10; i++ {
+		code := GeneratePassword(10)
+		codes = append(codes, code)
+		hashes = append(hashes, HashToken(code))
+	}
+	if err := db.Model(user).Updates(map[string]interface{}{
+		"totp_enabled":   true,
+		"totp_counter":   counter,
+		"recovery_codes": strings.Join(hashes, ","),
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTotp godoc
+// @Summary Disable TOTP of the current user
+// @Tags auth
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param code body models.TotpInput true "Code of the authenticator app or a recovery code"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/totp/disable [post]
+func DisableTotp(c *gin.Context, db *gorm.DB) {
+	var input models.TotpInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := currentUser(c, db)
+	if !ok {
+		return
+	}
+	if !user.TotpEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "totp not enabled"})
+		return
+	}
+	if !VerifySecondFactor(db, user, input.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+		return
+	}
+
+	if err := db.Model(user).Updates(disableTotp()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "totp disabled"})
+}
+
+func disableTotp() map[string]interface{} {
+	return map[string]interface{}{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"totp_counter":   0,
+		"recovery_codes": "",
+	}
+}
+
+// ResetExUserTotp godoc
+// @Summary Disable TOTP of an user
+// @Description For users who lost their device and their recovery codes
+// @Tags user
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.ExUser EID"
+// @Param id path int true "models.ExUser ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/users/{id}/totp [delete]
+func ResetExUserTotp(c *gin.Context, db *gorm.DB) {
+	var user models.ExUser
+	if result := TenantDB(c, db).First(&user, c.Param("id")); result.Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if !CanGrantRole(c, user.EffectiveRole()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "can not modify an user with role " + user.EffectiveRole()})
+		return
+	}
+
+	if err := db.Model(&user).Updates(disableTotp()).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "totp disabled"})
+}
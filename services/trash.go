@@ -0,0 +1,446 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"errors"
+	"go-http-svc/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Deletes are soft, see models.SoftDelete. Deleted records stay in the
+// trash of their exhibition until they are restored or purged.
+
+var errRestoreParent = errors.New("restore the parent first")
+
+type trashKind struct {
+	model func() interface{}
+	list  func() interface{}
+	perm  string
+	// checks that what the record points to isn't deleted, returns errRestoreParent
+	canRestore func(tx *gorm.DB, id int) error
+	// restores or purges what was deleted along with the record, at or after deletedAt
+	restore func(tx *gorm.DB, id int, deletedAt time.Time) error
+	purge   func(tx *gorm.DB, id int, deletedAt time.Time) error
+	// renames the users about to be restored whose uname was taken since,
+	// old uname to new uname in renamed, nil when there are no users
+	freeUnames func(tx *gorm.DB, id int, deletedAt time.Time, renamed map[string]string) error
+}
+
+// feedbackModels are deleted along with their item or user
+var feedbackModels = []func() interface{}{
+	func() interface{} { return &models.ExRate{} },
+	func() interface{} { return &models.ExAmount{} },
+	func() interface{} { return &models.ExComment{} },
+}
+
+// exibitionContent is soft deleted and restored along with its exhibition
+var exibitionContent = []func() interface{}{
+	func() interface{} { return &models.ExCatalog{} },
+	func() interface{} { return &models.ExItem{} },
+	func() interface{} { return &models.ExUser{} },
+	func() interface{} { return &models.ExRate{} },
+	func() interface{} { return &models.ExAmount{} },
+	func() interface{} { return &models.ExComment{} },
+}
+
+// exibitionAccess lets users into an exhibition, revoked (is_active false)
+// when it's deleted and not given back by a restore
+var exibitionAccess = []func() interface{}{
+	func() interface{} { return &models.ExSession{} },
+	func() interface{} { return &models.ExInvitation{} },
+	func() interface{} { return &models.ExLoginToken{} },
+	func() interface{} { return &models.ExApiKey{} },
+}
+
+// exibitionModels hold the rows of an exhibition, by eid, all purged with it
+var exibitionModels = append(append(append([]func() interface{}{}, exibitionContent...), exibitionAccess...),
+	func() interface{} { return &models.ExItemResult{} },
+	func() interface{} { return &models.ExibitionTransition{} },
+	func() interface{} { return &models.ExAttrDef{} },
+)
+
+// deleteFeedback soft deletes the rates, amounts and comments of an item
+// (column iid) or of an user (column uid)
+func deleteFeedback(tx *gorm.DB, column string, id int) error {
+	for _, model := range feedbackModels {
+		if err := tx.Where(column+"=?", id).Delete(model()).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFeedback restores the rates, amounts and comments of an item or of
+// an user deleted along with it, at or after deletedAt, except those whose
+// user or item is still deleted
+func restoreFeedback(tx *gorm.DB, column string, id int, deletedAt time.Time) error {
+	other := "uid in (select id from ex_users where is_deleted = false)"
+	if column == "uid" {
+		other = "iid in (select id from ex_items where is_deleted = false)"
+	}
+	for _, model := range feedbackModels {
+		if err := tx.Unscoped().Model(model()).Where(column+"=? and is_deleted=? and update_time>=?", id, true, deletedAt).Where(other).
+			Update("is_deleted", false).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func purgeFeedback(tx *gorm.DB, column string, id int) error {
+	for _, model := range feedbackModels {
+		if err := tx.Unscoped().Where(column+"=?", id).Delete(model()).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameTakenUnames renames the deleted users matching query whose uname
+// was given to another user since they were deleted, see ExUser.Live
+func renameTakenUnames(tx *gorm.DB, renamed map[string]string, query string, args ...interface{}) error {
+	var users []models.ExUser
+	if err := tx.Unscoped().Select("id, uname").Where("is_deleted=?", true).Where(query, args...).
+		Where("uname in (select uname from ex_users where is_deleted = false)").Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		uname := user.Uname + "_" + generateRandomUsername(4)
+		if err := tx.Unscoped().Model(&user).UpdateColumn("uname", uname).Error; err != nil {
+			return err
+		}
+		renamed[user.Uname] = uname
+	}
+	return nil
+}
+
+// exists tells whether the record id of model is there and not deleted, 0
+// stands for none
+func exists(tx *gorm.DB, model interface{}, id int) bool {
+	if id == 0 {
+		return true
+	}
+	var count int64
+	tx.Model(model).Where("id=?", id).Count(&count)
+	return count > 0
+}
+
+func feedbackCanRestore(model func() interface{}) func(tx *gorm.DB, id int) error {
+	return func(tx *gorm.DB, id int) error {
+		var ref struct{ Uid, Iid int }
+		if err := tx.Unscoped().Model(model()).Select("uid, iid").Where("id=?", id).Scan(&ref).Error; err != nil {
+			return err
+		}
+		if !exists(tx, &models.ExUser{}, ref.Uid) || !exists(tx, &models.ExItem{}, ref.Iid) {
+			return errRestoreParent
+		}
+		return nil
+	}
+}
+
+func noop(tx *gorm.DB, id int) error {
+	return nil
+}
+
+func noopSince(tx *gorm.DB, id int, deletedAt time.Time) error {
+	return nil
+}
+
+// catalogTree applies do to the catalogs and the items deleted along with
+// catalog id by a cascade delete, see DeletePlan
+func catalogTree(do func(tx *gorm.DB, catalogs []int, items []int, deletedAt time.Time) error) func(tx *gorm.DB, id int, deletedAt time.Time) error {
+	return func(tx *gorm.DB, id int, deletedAt time.Time) error {
+		catalogs, items, err := deletedWithCatalog(tx, id, deletedAt)
+		if err != nil {
+			return err
+		}
+		return do(tx, catalogs, items, deletedAt)
+	}
+}
+
+var trashKinds = map[string]trashKind{
+	"catalogs": {
+		model: func() interface{} { return &models.ExCatalog{} },
+		list:  func() interface{} { return &[]models.ExCatalog{} },
+		perm:  models.PermCatalogWrite,
+		canRestore: func(tx *gorm.DB, id int) error {
+			var catalog models.ExCatalog
+			if err := tx.Unscoped().First(&catalog, id).Error; err != nil {
+				return err
+			}
+			if !exists(tx, &models.ExCatalog{}, catalog.Pid) {
+				return errRestoreParent
+			}
+			return nil
+		},
+		restore: catalogTree(func(tx *gorm.DB, catalogs []int, items []int, deletedAt time.Time) error {
+			if len(catalogs) > 0 {
+				if err := tx.Unscoped().Model(&models.ExCatalog{}).Where("id in ?", catalogs).Update("is_deleted", false).Error; err != nil {
+					return err
+				}
+			}
+			for _, item := range items {
+				if err := tx.Unscoped().Model(&models.ExItem{}).Where("id=?", item).Update("is_deleted", false).Error; err != nil {
+					return err
+				}
+				if err := restoreFeedback(tx, "iid", item, deletedAt); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		purge: catalogTree(func(tx *gorm.DB, catalogs []int, items []int, deletedAt time.Time) error {
+			if len(catalogs) > 0 {
+				if err := tx.Unscoped().Where("id in ?", catalogs).Delete(&models.ExCatalog{}).Error; err != nil {
+					return err
+				}
+			}
+			for _, item := range items {
+				if err := tx.Unscoped().Where("id=?", item).Delete(&models.ExItem{}).Error; err != nil {
+					return err
+				}
+				if err := purgeFeedback(tx, "iid", item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	},
+	"items": {
+		model: func() interface{} { return &models.ExItem{} },
+		list:  func() interface{} { return &[]models.ExItem{} },
+		perm:  models.PermItemWrite,
+		canRestore: func(tx *gorm.DB, id int) error {
+			var item models.ExItem
+			if err := tx.Unscoped().First(&item, id).Error; err != nil {
+				return err
+			}
+			if !exists(tx, &models.ExCatalog{}, item.Cid) {
+				return errRestoreParent
+			}
+			return nil
+		},
+		restore: func(tx *gorm.DB, id int, deletedAt time.Time) error { return restoreFeedback(tx, "iid", id, deletedAt) },
+		purge:   func(tx *gorm.DB, id int, deletedAt time.Time) error { return purgeFeedback(tx, "iid", id) },
+	},
+	"users": {
+		model:      func() interface{} { return &models.ExUser{} },
+		list:       func() interface{} { return &[]models.ExUser{} },
+		perm:       models.PermUserManage,
+		canRestore: noop,
+		restore:    func(tx *gorm.DB, id int, deletedAt time.Time) error { return restoreFeedback(tx, "uid", id, deletedAt) },
+		purge:      func(tx *gorm.DB, id int, deletedAt time.Time) error { return purgeFeedback(tx, "uid", id) },
+		freeUnames: func(tx *gorm.DB, id int, deletedAt time.Time, renamed map[string]string) error {
+			return renameTakenUnames(tx, renamed, "id=?", id)
+		},
+	},
+	"rates": {
+		model:      feedbackModels[0],
+		list:       func() interface{} { return &[]models.ExRate{} },
+		perm:       models.PermItemWrite,
+		canRestore: feedbackCanRestore(feedbackModels[0]),
+		restore:    noopSince,
+		purge:      noopSince,
+	},
+	"amounts": {
+		model:      feedbackModels[1],
+		list:       func() interface{} { return &[]models.ExAmount{} },
+		perm:       models.PermItemWrite,
+		canRestore: feedbackCanRestore(feedbackModels[1]),
+		restore:    noopSince,
+		purge:      noopSince,
+	},
+	"comments": {
+		model:      feedbackModels[2],
+		list:       func() interface{} { return &[]models.ExComment{} },
+		perm:       models.PermItemWrite,
+		canRestore: feedbackCanRestore(feedbackModels[2]),
+		restore:    noopSince,
+		purge:      noopSince,
+	},
+}
+
+// exibitionTrash is the trash of exhibitions, not scoped by an eid
+var exibitionTrash = trashKind{
+	model:      func() interface{} { return &models.Exibition{} },
+	list:       func() interface{} { return &[]models.Exibition{} },
+	perm:       models.PermExibitionManage,
+	canRestore: noop,
+	freeUnames: func(tx *gorm.DB, id int, deletedAt time.Time, renamed map[string]string) error {
+		return renameTakenUnames(tx, renamed, "eid=? and update_time>=?", id, deletedAt)
+	},
+	// its catalogs, items, users, rates, amounts and comments deleted along with it
+	restore: func(tx *gorm.DB, id int, deletedAt time.Time) error {
+		for _, model := range exibitionContent {
+			if err := tx.Unscoped().Model(model()).Where("eid=? and is_deleted=? and update_time>=?", id, true, deletedAt).
+				Update("is_deleted", false).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	purge: func(tx *gorm.DB, id int, deletedAt time.Time) error {
+		for _, model := range exibitionModels {
+			if err := tx.Unscoped().Where("eid=?", id).Delete(model()).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// getTrashKind resolves the :kind of an /:eid route, exhibitions have
+// their own trash outside of the /:eid routes. Returns the db to use.
+func getTrashKind(c *gin.Context, db *gorm.DB) (trashKind, *gorm.DB, bool) {
+	if _, scoped := c.Get("eid"); !scoped {
+		return exibitionTrash, db, true
+	}
+	kind, ok := trashKinds[c.Param("kind")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown kind " + c.Param("kind")})
+		return kind, nil, false
+	}
+	if !HasPerm(c, kind.perm) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "permission denied: " + kind.perm})
+		return kind, nil, false
+	}
+	return kind, TenantDB(c, db), true
+}
+
+// deletedTime returns when record id of the trash was deleted, the soft
+// delete sets update_time
+func deletedTime(tx *gorm.DB, kind trashKind, id int) (time.Time, error) {
+	var record models.Base
+	result := tx.Unscoped().Model(kind.model()).Select("update_time").Where("id=? and is_deleted=?", id, true).Scan(&record)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return record.UpdateTime, gorm.ErrRecordNotFound
+	}
+	return record.UpdateTime, result.Error
+}
+
+// GetTrash godoc
+// @Summary List the deleted records of an exhibition
+// @Description The most recently deleted first. kind is one of catalogs, items, users, rates,
+// @Description amounts, comments, each needing the permission to write them.
+// @Tags trash
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param kind path string true "catalogs, items, users, rates, amounts or comments"
+// @Success 200 {array} map[string]interface{}
+// @Router /api/{eid}/trash/{kind} [get]
+// @Router /api/trash/exibitions [get]
+func GetTrash(c *gin.Context, db *gorm.DB) {
+	kind, tdb, ok := getTrashKind(c, db)
+	if !ok {
+		return
+	}
+	records := kind.list()
+	if result := tdb.Unscoped().Where("is_deleted=?", true).Order("update_time desc").Find(records); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, records)
+}
+
+// RestoreTrash godoc
+// @Summary Restore a deleted record
+// @Description Rates, amounts and comments deleted along with an item or an user come back with it,
+// @Description so does what a cascade delete of a catalog or an exibition deleted. Refused while the
+// @Description catalog, item or user the record belongs to is deleted. Users whose uname was taken
+// @Description since they were deleted get a new one, see renamed, old uname to new uname.
+// @Tags trash
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param kind path string true "catalogs, items, users, rates, amounts or comments"
+// @Param id path int true "record ID"
+// @Success 200 {object} map[string]interface{}
+// @Failure 409 {object} map[string]interface{}
+// @Router /api/{eid}/trash/{kind}/{id}/restore [post]
+// @Router /api/trash/exibitions/{id}/restore [post]
+func RestoreTrash(c *gin.Context, db *gorm.DB) {
+	kind, tdb, ok := getTrashKind(c, db)
+	if !ok {
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	renamed := map[string]string{}
+	err := tdb.Transaction(func(tx *gorm.DB) error {
+		deletedAt, err := deletedTime(tx, kind, id)
+		if err != nil {
+			return err
+		}
+		if kind.freeUnames != nil {
+			if err := kind.freeUnames(tx, id, deletedAt, renamed); err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Model(kind.model()).Where("id=?", id).Update("is_deleted", false).Error; err != nil {
+			return err
+		}
+		if err := kind.canRestore(tx, id); err != nil {
+			return err
+		}
+		return kind.restore(tx, id, deletedAt)
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found in the trash"})
+	case errors.Is(err, errRestoreParent):
+		c.JSON(http.StatusConflict, gin.H{"error": "what it belongs to is deleted, restore it first"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusOK, gin.H{"message": "restored successfully", "renamed": renamed})
+	}
+}
+
+// PurgeTrash godoc
+// @Summary Delete a record of the trash for good
+// @Description Purging an item or an user purges its rates, amounts and comments too, purging a
+// @Description catalog purges what its cascade delete deleted, purging an exibition purges everything of it.
+// @Tags trash
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param kind path string true "catalogs, items, users, rates, amounts or comments"
+// @Param id path int true "record ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/trash/{kind}/{id} [delete]
+// @Router /api/trash/exibitions/{id} [delete]
+func PurgeTrash(c *gin.Context, db *gorm.DB) {
+	kind, tdb, ok := getTrashKind(c, db)
+	if !ok {
+		return
+	}
+	id, _ := strconv.Atoi(c.Param("id"))
+
+	err := tdb.Transaction(func(tx *gorm.DB) error {
+		deletedAt, err := deletedTime(tx, kind, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("id=?", id).Delete(kind.model()).Error; err != nil {
+			return err
+		}
+		return kind.purge(tx, id, deletedAt)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found in the trash"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "purged successfully"})
+}
@@ -0,0 +1,150 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package services
+
+import (
+	"go-http-svc/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CatalogFigures sums up the items of a catalog
+type CatalogFigures struct {
+	Items       int     `json:"items"`
+	AvgRate     float64 `json:"avg_rate"`
+	TotalAmount int     `json:"total_amount"`
+	// the average is over all the rates, not over the averages of the items
+	RateSum float64 `json:"-"`
+	Rates   int     `json:"-"`
+}
+
+func (f *CatalogFigures) add(o CatalogFigures) {
+	f.Items += o.Items
+	f.TotalAmount += o.TotalAmount
+	f.RateSum += o.RateSum
+	f.Rates += o.Rates
+	if f.Rates > 0 {
+		f.AvgRate = f.RateSum / float64(f.Rates)
+	}
+}
+
+// CatalogNode is a catalog of the tree returned by GetExCatalogsTree
+type CatalogNode struct {
+	models.ExCatalog
+	Depth int `json:"depth"`
+	// the items of the catalog itself, and of the catalog and all of its subtree
+	Direct   CatalogFigures `json:"direct"`
+	Total    CatalogFigures `json:"total"`
+	Children []*CatalogNode `json:"children"`
+}
+
+// sum fills Total and Depth of the subtree of the node, and cuts off the
+// children deeper than maxDepth, 0 for no limit. seen has the nodes summed
+// so far, a child among them closes a cycle in pid and is left out.
+func (n *CatalogNode) sum(depth int, maxDepth int, seen map[int]bool) {
+	seen[n.ID] = true
+	n.Depth = depth
+	n.Total.add(n.Direct)
+	children := []*CatalogNode{}
+	for _, child := range n.Children {
+		if seen[child.ID] {
+			continue
+		}
+		child.sum(depth+1, maxDepth, seen)
+		n.Total.add(child.Total)
+		children = append(children, child)
+	}
+	n.Children = children
+	if maxDepth > 0 && depth >= maxDepth {
+		n.Children = []*CatalogNode{}
+	}
+}
+
+// catalogFigures returns the figures of the items of each catalog of the
+// exhibition, by catalog id
+func catalogFigures(db *gorm.DB, eid int) (map[int]CatalogFigures, error) {
+	var rows []struct {
+		Cid int
+		CatalogFigures
+	}
+	if err := db.Table("ex_items").
+		Select("ex_items.cid, COUNT(*) as items, COALESCE(SUM(rates.rate_sum), 0) as rate_sum, "+
+			"COALESCE(SUM(rates.rates), 0) as rates, COALESCE(SUM(amounts.total_amount), 0) as total_amount").
+		Joins("LEFT JOIN (SELECT iid, SUM(rate) as rate_sum, COUNT(*) as rates FROM ex_rates WHERE eid = ? and is_deleted = false GROUP BY iid) as rates ON rates.iid = ex_items.id", eid).
+		Joins("LEFT JOIN (SELECT iid, SUM(amount) as total_amount FROM ex_amounts WHERE eid = ? and is_deleted = false GROUP BY iid) as amounts ON amounts.iid = ex_items.id", eid).
+		Where("ex_items.eid = ? and ex_items.is_deleted = false", eid).
+		Group("ex_items.cid").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	figures := make(map[int]CatalogFigures, len(rows))
+	for _, row := range rows {
+		var f CatalogFigures
+		f.add(row.CatalogFigures)
+		figures[row.Cid] = f
+	}
+	return figures, nil
+}
+
+// GetExCatalogsTree godoc
+// @Summary Get the catalogs as a tree
+// @Description The top level catalogs, or the catalog root alone, each with its children nested.
+// @Description Every node has the number of items, the average rate and the total amount of its own
+// @Description items (direct) and of its whole subtree (total), which depth doesn't limit.
+// @Tags catalog
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.Exibition ID"
+// @Param root query int false "catalog ID of the root, the top level by default"
+// @Param depth query int false "levels of children to return, all by default"
+// @Success 200 {array} CatalogNode
+// @Router /api/{eid}/catalogs_tree [get]
+func GetExCatalogsTree(c *gin.Context, db *gorm.DB) {
+	eid := GetEid(c)
+	root, _ := strconv.Atoi(c.Query("root"))
+	depth, _ := strconv.Atoi(c.Query("depth"))
+
+	var catalogs []models.ExCatalog
+	if result := TenantDB(c, db).Order("sort, id").Find(&catalogs); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	figures, err := catalogFigures(db, eid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	nodes := make(map[int]*CatalogNode, len(catalogs))
+	for _, catalog := range catalogs {
+		nodes[catalog.ID] = &CatalogNode{ExCatalog: catalog, Direct: figures[catalog.ID], Children: []*CatalogNode{}}
+	}
+	tops := []*CatalogNode{}
+	for _, catalog := range catalogs {
+		node := nodes[catalog.ID]
+		// a catalog being its own parent can't be reached anyway
+		if parent, ok := nodes[catalog.Pid]; ok && catalog.Pid != catalog.ID {
+			parent.Children = append(parent.Children, node)
+		} else if catalog.Pid == 0 {
+			tops = append(tops, node)
+		}
+	}
+	if root != 0 {
+		node, ok := nodes[root]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "catalog not found"})
+			return
+		}
+		tops = []*CatalogNode{node}
+	}
+
+	seen := map[int]bool{}
+	for _, node := range tops {
+		node.sum(0, depth, seen)
+	}
+	c.JSON(http.StatusOK, tops)
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -26,23 +27,13 @@ import (
 // @Success 200 {array} models.ExUser
 // @Router /api/{eid}/users [get]
 func GetExUsers(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-	eid, err := strconv.Atoi(c.Param("eid"))
-	fmt.Println(eid, err)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
 	q := c.Query("q")
 	if q != "" {
 		q = "%" + q + "%"
 	}
 
 	var users []models.ExUser
-	query := db.Where("eid=?", eid).Order("id desc")
+	query := TenantDB(c, db).Order("id desc")
 	if q != "" {
 		query = query.Where("name like ? or title like ? or uname like ? or mobile like ?", q, q, q, q)
 	}
@@ -64,25 +55,31 @@ func GetExUsers(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExUser
 // @Router /api/{eid}/users [post]
 func CreateExUser(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
+	eid := GetEid(c)
 	var input models.ExUserInput
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	input.Eid = eid
+	if input.Role == "" {
+		input.Role = models.DefaultRole(eid)
+	}
+	if !models.IsRoleOfEid(input.Role, eid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role for eid " + strconv.Itoa(eid)})
+		return
+	}
+	if !CanGrantRole(c, input.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "can not grant role " + input.Role})
+		return
+	}
 	user := models.ExUser{
 		ExUserInput: input,
 	}
+	if err := setInitialPassword(&user, input.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
 
 	if result := db.Create(&user); result.Error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": result.Error})
@@ -93,23 +90,20 @@ func CreateExUser(c *gin.Context, db *gorm.DB) {
 
 // BatchCreateExUser godoc
 // @Summary Create new users by batch
+// @Description Every user gets a generated password, returned once in initial_password
 // @Tags user
 // @Security BearerAuth
 // @Accept  json
 // @Produce  json
 // @Param eid path int true "models.ExUser EID"
+// @Param export query string false "xlsx: download the credentials as a spreadsheet"
 // @Param user body models.BatchUserInput true "BatchUserInput Input"
-// @Success 200 {object} models.ExUser
+// @Success 200 {array} models.ExUser
 // @Router /api/{eid}/users [put]
 func BatchCreateExUser(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
+	eid := GetEid(c)
+	if !models.IsRoleOfEid(models.RoleJudge, eid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role for eid " + strconv.Itoa(eid)})
 		return
 	}
 	var input models.BatchUserInput
@@ -123,12 +117,16 @@ func BatchCreateExUser(c *gin.Context, db *gorm.DB) {
 		name := input.NamePrefix + strconv.Itoa(i)
 		user := models.ExUser{
 			ExUserInput: models.ExUserInput{
-				Eid:      eid,
-				Uname:    name,
-				Password: "0000",
-				Name:     name,
+				Eid:   eid,
+				Uname: name,
+				Name:  name,
+				Role:  models.RoleJudge,
 			},
 		}
+		if err := setInitialPassword(&user, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
 		users = append(users, user)
 	}
 
@@ -136,7 +134,7 @@ func BatchCreateExUser(c *gin.Context, db *gorm.DB) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": result.Error})
 		return
 	}
-	c.JSON(http.StatusOK, users)
+	respondCredentials(c, users)
 }
 
 // GetExUser godoc
@@ -150,17 +148,11 @@ func BatchCreateExUser(c *gin.Context, db *gorm.DB) {
 // @Router /api/{eid}/users/{id} [get]
 func GetExUser(c *gin.Context, db *gorm.DB) {
 	id := c.Param("id")
-	if !IsAdmin(c) && id != "0" {
+	if !HasPerm(c, models.PermUserManage) && id != "0" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin/self_user only"})
 		return
 	}
 
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
-
 	claim, _ := c.Get("user")
 	u := claim.(*models.Claims)
 
@@ -171,7 +163,7 @@ func GetExUser(c *gin.Context, db *gorm.DB) {
 	fmt.Println("uid: ", id)
 
 	var user models.ExUser
-	if result := db.Where("eid=? and id=?", eid, id).First(&user); result.Error != nil {
+	if result := TenantDB(c, db).Where("id=?", id).First(&user); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
@@ -190,19 +182,9 @@ func GetExUser(c *gin.Context, db *gorm.DB) {
 // @Success 200 {object} models.ExUser
 // @Router /api/{eid}/users/{id} [patch]
 func UpdateExUser(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
 	id := c.Param("id")
 	var user models.ExUser
-	if result := db.Where("eid=?", eid).First(&user, id); result.Error != nil {
+	if result := TenantDB(c, db).First(&user, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
@@ -214,6 +196,69 @@ func UpdateExUser(c *gin.Context, db *gorm.DB) {
 	}
 	input := ProcessInput(input_).(map[string]interface{})
 
+	if role, ok := input["role"]; ok {
+		role, _ := role.(string)
+		if !models.IsValidRole(role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role"})
+			return
+		}
+		if !CanGrantRole(c, role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "can not grant role " + role})
+			return
+		}
+	}
+	// an exhibition admin must not move users out of the exhibition,
+	// nor touch users holding a role above their own
+	dropBaseFields(input)
+	// the second factor is managed by its owner through /api/totp
+	for _, key := range []string{"totp_enabled", "totp_secret", "totp_counter", "recovery_codes"} {
+		delete(input, key)
+	}
+	// linked on the first OpenID Connect login
+	delete(input, "oidc_subject")
+	if _, ok := input["eid"]; ok && !HasPerm(c, models.PermExibitionManage) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "can not change eid"})
+		return
+	}
+	if !CanGrantRole(c, user.EffectiveRole()) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "can not modify an user with role " + user.EffectiveRole()})
+		return
+	}
+	// the role and the eid change together, see models.IsRoleOfEid
+	_, setRole := input["role"]
+	_, setEid := input["eid"]
+	if setRole || setEid {
+		role, eid := user.EffectiveRole(), user.Eid
+		if value, ok := input["role"].(string); ok {
+			role = value
+		}
+		if value, ok := input["eid"].(float64); ok {
+			eid = int(value)
+		} else if setEid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
+			return
+		}
+		if !models.IsRoleOfEid(role, eid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role for eid " + strconv.Itoa(eid)})
+			return
+		}
+	}
+	// a password set by an admin is a temporary one
+	if password, ok := input["password"]; ok {
+		password, _ := password.(string)
+		if password == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "empty password"})
+			return
+		}
+		hash, err := HashPassword(password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+		input["password"] = hash
+		input["must_change_password"] = true
+	}
+
 	var fieldsToUpdate []string
 	for key := range input {
 		fieldsToUpdate = append(fieldsToUpdate, key)
@@ -238,43 +283,48 @@ func UpdateExUser(c *gin.Context, db *gorm.DB) {
 // @Success 200
 // @Router /api/{eid}/users/{id} [delete]
 func DeleteExUser(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
-
 	id := c.Param("id")
 	var user models.ExUser
-	if result := db.Where("eid=?", eid).First(&user, id); result.Error != nil {
+	if result := TenantDB(c, db).First(&user, id); result.Error != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
 
-	db.Delete(&user)
+	// soft, with their rates, amounts and comments, see RestoreTrash
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&user).Error; err != nil {
+			return err
+		}
+		if err := deleteFeedback(tx, "uid", user.ID); err != nil {
+			return err
+		}
+		return tx.Model(&models.ExSession{}).Where("uid=? and is_active=?", user.ID, true).Update("is_active", false).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "user deleted successfully"})
 }
 
 // @Summary Create Users from template xlsx file
+// @Description Every user gets a generated password, returned once in initial_password
 // @Tags user
 // @Security BearerAuth
 // @Accept mpfd
 // @Produce json
+// @Param export query string false "xlsx: download the credentials as a spreadsheet"
 // @Param file formData file true "user_template.xlsx to upload"
+// @Success 200 {array} models.ExUser
 // @Router /api/{eid}/users_tmpl [put]
 func CreateUserFromTemplate(c *gin.Context, db *gorm.DB) {
-	// Get the file from the form
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
+	eid := GetEid(c)
+	if !models.IsRoleOfEid(models.RoleJudge, eid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role for eid " + strconv.Itoa(eid)})
 		return
 	}
 
-	eid, _ := strconv.Atoi(c.Param("eid"))
+	// Get the file from the form
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
@@ -301,13 +351,17 @@ func CreateUserFromTemplate(c *gin.Context, db *gorm.DB) {
 
 		user := models.ExUser{
 			ExUserInput: models.ExUserInput{
-				Eid:      eid,
-				Title:    row["title"],
-				Uname:    generateRandomUsername(5) + strconv.Itoa(i),
-				Password: "0000",
-				Name:     row["name"],
+				Eid:   eid,
+				Title: row["title"],
+				Uname: generateRandomUsername(5) + strconv.Itoa(i),
+				Name:  row["name"],
+				Role:  models.RoleJudge,
 			},
 		}
+		if err := setInitialPassword(&user, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
 		users = append(users, user)
 	}
 	if len(users) > 0 {
@@ -315,7 +369,7 @@ func CreateUserFromTemplate(c *gin.Context, db *gorm.DB) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": result.Error})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"message": "users created successfully"})
+		respondCredentials(c, users)
 	}
 }
 
@@ -331,16 +385,6 @@ func CreateUserFromTemplate(c *gin.Context, db *gorm.DB) {
 // @Success 200 {array} models.ExUser
 // @Router /api/{eid}/active_users [post]
 func ActiveExUser(c *gin.Context, db *gorm.DB) {
-	if !IsAdmin(c) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "admin only"})
-		return
-	}
-
-	eid, err := strconv.Atoi(c.Param("eid"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid eid"})
-		return
-	}
 	var input []int
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -351,10 +395,55 @@ func ActiveExUser(c *gin.Context, db *gorm.DB) {
 		return
 	}
 	active, _ := strconv.ParseBool(c.Query("active"))
-	if result := db.Model(&models.ExUser{}).Where("eid=? and id in ?", eid, input).Update("is_active", active); result.Error != nil {
+	if result := TenantDB(c, db).Model(&models.ExUser{}).Where("id in ?", input).Update("is_active", active); result.Error != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": result.Error})
 		return
 	}
+	// disabled users lose their sessions right away
+	if !active {
+		TenantDB(c, db).Model(&models.ExSession{}).Where("uid in ?", input).Update("is_active", false)
+	}
 
 	c.JSON(http.StatusOK, nil)
 }
+
+// GetExUserSessions godoc
+// @Summary Get sessions of an user
+// @Tags user
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.ExUser EID"
+// @Param id path int true "models.ExUser ID"
+// @Success 200 {array} models.ExSession
+// @Router /api/{eid}/users/{id}/sessions [get]
+func GetExUserSessions(c *gin.Context, db *gorm.DB) {
+	id := c.Param("id")
+
+	var sessions []models.ExSession
+	if result := TenantDB(c, db).Where("uid=? and is_active=? and expires_at>?", id, true, time.Now()).Order("id desc").Find(&sessions); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeExUserSessions godoc
+// @Summary Revoke all sessions of an user
+// @Description Access tokens of the sessions stop working immediately, eg. when a device is lost
+// @Tags user
+// @Security BearerAuth
+// @Produce json
+// @Param eid path int true "models.ExUser EID"
+// @Param id path int true "models.ExUser ID"
+// @Success 200 {object} map[string]interface{}
+// @Router /api/{eid}/users/{id}/sessions [delete]
+func RevokeExUserSessions(c *gin.Context, db *gorm.DB) {
+	id := c.Param("id")
+
+	result := TenantDB(c, db).Model(&models.ExSession{}).Where("uid=? and is_active=?", id, true).Update("is_active", false)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "sessions revoked", "count": result.RowsAffected})
+}
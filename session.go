@@ -0,0 +1,159 @@
+// Author: Bruce Lu
+// Email: lzbgt_AT_icloud.com
+
+package main
+
+import (
+	"go-http-svc/models"
+	"go-http-svc/services"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// envDuration reads a duration like "15m" from the environment
+func envDuration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+func accessTokenTTL() time.Duration {
+	return envDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+func refreshTokenTTL() time.Duration {
+	return envDuration("REFRESH_TOKEN_TTL", 4*7*24*time.Hour)
+}
+
+// issueSession starts a new session for the user and responds with
+// the access token and the refresh token. method is one of
+// models.SessionMethod*.
+func issueSession(c *gin.Context, db *gorm.DB, user models.ExUser, method string) {
+	refreshToken := services.RandomToken(32)
+	session := models.ExSession{
+		Sid:       services.RandomToken(16),
+		Uid:       user.ID,
+		Eid:       user.Eid,
+		TokenHash: services.HashToken(refreshToken),
+		ExpiresAt: time.Now().Add(refreshTokenTTL()),
+		UserAgent: c.Request.UserAgent(),
+		Ip:        c.ClientIP(),
+		Method:    method,
+	}
+	if err := db.Create(&session).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	respondTokens(c, user, session, refreshToken)
+}
+
+// respondTokens hands out the token pair of the session. Users logged in
+// with a login token or OpenID Connect never type a password, so they are
+// not asked to change it.
+func respondTokens(c *gin.Context, user models.ExUser, session models.ExSession, refreshToken string) {
+	if session.Method == models.SessionMethodLoginToken || session.Method == models.SessionMethodOidc {
+		user.MustChangePassword = false
+	}
+	token, err := GenerateToken(user, session.Sid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":                token,
+		"refresh_token":        refreshToken,
+		"expires_in":           int(accessTokenTTL().Seconds()),
+		"must_change_password": user.MustChangePassword,
+	})
+}
+
+// Refresh godoc
+// @Summary Exchange a refresh token for a new token pair
+// @Description The refresh token is single use, the response carries its replacement.
+// @Description Presenting an already rotated refresh token revokes the whole session.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param token body models.RefreshInput true "Refresh token"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} map[string]interface{}
+// @Router /refresh [post]
+func Refresh(c *gin.Context, db *gorm.DB) {
+	var input models.RefreshInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	hash := services.HashToken(input.RefreshToken)
+
+	var session models.ExSession
+	if result := db.Where("token_hash=?", hash).First(&session); result.Error != nil {
+		// a rotated token showing up again means it has leaked
+		if result := db.Where("prev_token_hash=?", hash).First(&session); result.Error == nil {
+			db.Model(&session).Update("is_active", false)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if !session.IsActive || session.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "session expired"})
+		return
+	}
+
+	var user models.ExUser
+	if result := db.First(&user, session.Uid); result.Error != nil || !user.IsActive {
+		db.Model(&session).Update("is_active", false)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user disabled"})
+		return
+	}
+
+	refreshToken := services.RandomToken(32)
+	result := db.Model(&session).Where("token_hash=?", hash).Updates(map[string]interface{}{
+		"token_hash":      services.HashToken(refreshToken),
+		"prev_token_hash": hash,
+	})
+	if result.Error != nil || result.RowsAffected == 0 {
+		// lost the race against a concurrent refresh with the same token
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	respondTokens(c, user, session, refreshToken)
+}
+
+// Logout godoc
+// @Summary Log out, revoking the current session
+// @Tags auth
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /logout [post]
+func Logout(c *gin.Context, db *gorm.DB) {
+	claim, _ := c.Get("user")
+	claims := claim.(*models.Claims)
+
+	if result := db.Model(&models.ExSession{}).Where("sid=?", claims.Sid).Update("is_active", false); result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// isSessionActive is the revocation check done on every authenticated request
+func isSessionActive(db *gorm.DB, sid string) bool {
+	if sid == "" {
+		return false
+	}
+	var session models.ExSession
+	if result := db.Select("id, is_active, expires_at").Where("sid=?", sid).First(&session); result.Error != nil {
+		return false
+	}
+	return session.IsActive && session.ExpiresAt.After(time.Now())
+}